@@ -1,14 +1,26 @@
 package spki
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/eadmund/sexprs"
+	"strconv"
 )
 
+var delegateAtom = sexprs.Atom{Value: []byte("delegate")}
+
+// An AuthCert grants the authorisation Tag from its Issuer to its
+// Subject.  If Delegate is true the subject may pass that
+// authorisation on: through a chain of at most Depth further
+// certificates if Depth is positive, or without limit if it is zero.
+// Depth is written as (delegate N), and an unlimited delegation as
+// plain (delegate).
 type AuthCert struct {
 	Expr sexprs.Sexp // the originally-parsed S-expression, for hashing
 	Issuer Name
 	Subject Subject
 	Delegate bool
+	Depth int
 	Valid *Valid
 	Tag sexprs.Sexp
 }
@@ -24,8 +36,11 @@ func (a AuthCert) Sexp() sexprs.Sexp {
 	}
 	var ds, vs sexprs.Sexp
 	var s sexprs.List
-	if a.Delegate {
-		ds = sexprs.List{sexprs.Atom{Value: []byte("delegate")}}
+	switch {
+	case a.Delegate && a.Depth > 0:
+		ds = sexprs.List{delegateAtom, sexprs.Atom{Value: []byte(strconv.Itoa(a.Depth))}}
+	case a.Delegate:
+		ds = sexprs.List{delegateAtom}
 	}
 	if a.Valid != nil {
 		vs = a.Valid.Sexp()
@@ -43,6 +58,194 @@ func (a AuthCert) Sexp() sexprs.Sexp {
 	return s
 }
 
+// Pack returns a's canonical S-expression form.
+func (a AuthCert) Pack() []byte {
+	return a.Sexp().Pack()
+}
+
 func (a AuthCert) String() string {
 	return a.Sexp().String()
 }
+
+// Freeze sets a's Expr to the canonical form of its S-expression, so
+// that it hashes & is signed exactly as it will be once packed & parsed
+// again.  Thereafter a's Sexp ignores changes to its other fields,
+// until Expr is set to nil.  A certificate issued by IssueAuthCert has
+// no Expr until it is frozen.
+func (a *AuthCert) Freeze() error {
+	expr, _, err := sexprs.Parse(Canonicalize(a.Sexp()))
+	if err != nil {
+		return err
+	}
+	a.Expr = expr
+	return nil
+}
+
+// Equal returns true if a & b are the same certificate, i.e. if they
+// confer the same authorisation, as SemanticEqual.  If both were
+// parsed, i.e. both have an Expr, then identical canonical forms
+// suffice, which is faster to check.  Two nil certificates are equal.
+func (a *AuthCert) Equal(b *AuthCert) bool {
+	if a != nil && b != nil && a.Expr != nil && b.Expr != nil && bytes.Equal(Canonicalize(a.Expr), Canonicalize(b.Expr)) {
+		return true
+	}
+	return a.SemanticEqual(b)
+}
+
+// SemanticEqual returns true if a & b confer the same authorisation:
+// the same issuer, subject, delegation, tag and validity, where tags
+// are compared in the normal form of NormalizeTag.  Unlike a
+// comparison of their S-expressions, it ignores how either was
+// originally written, e.g. any comments in a parsed certificate.
+func (a *AuthCert) SemanticEqual(b *AuthCert) bool {
+	switch {
+	case a == nil || b == nil:
+		return a == b
+	case !a.Issuer.Equal(b.Issuer):
+		return false
+	case a.delegationDepth() != b.delegationDepth():
+		return false
+	case !subjectEqual(a, b):
+		return false
+	case !sexpEqual(NormalizeTag(a.Tag), NormalizeTag(b.Tag)):
+		return false
+	}
+	return validEqual(a.Valid, b.Valid)
+}
+
+// SubjectKey returns a's subject as a Key if it is one, i.e. if it is a
+// public key or the hash of one.  It returns false for any other kind
+// of subject.
+func (a *AuthCert) SubjectKey() (Key, bool) {
+	switch s := a.Subject.(type) {
+	case Key:
+		return s, true
+	case KeySubject:
+		return s.Key, s.Key != nil
+	case Hash:
+		return HashKey{[]Hash{s}}, true
+	}
+	return nil, false
+}
+
+// Cacheable returns false if a's validity includes a one-time online
+// test, in which case neither a nor anything derived from it, such as
+// the result of Reduce, may be cached.
+func (a *AuthCert) Cacheable() bool {
+	return a.Valid == nil || !a.Valid.IsOneTime()
+}
+
+// delegationDepth returns the number of further delegations a
+// permits: -1 if they are unlimited, 0 if a may not be delegated.
+func (a *AuthCert) delegationDepth() int {
+	switch {
+	case !a.Delegate:
+		return 0
+	case a.Depth <= 0:
+		return -1
+	}
+	return a.Depth
+}
+
+// setDelegationDepth sets a's Delegate & Depth from depth, as returned
+// by delegationDepth.
+func (a *AuthCert) setDelegationDepth(depth int) {
+	a.Delegate = depth != 0
+	a.Depth = 0
+	if depth > 0 {
+		a.Depth = depth
+	}
+}
+
+// EvalAuthCert converts an authorisation certificate S-expression to an
+// AuthCert.  A certificate looks like:
+//    (cert (issuer PRINCIPAL) (subject SUBJECT) (delegate N?)? TAG VALID?)
+// The returned certificate's Expr is s, so that it hashes & verifies
+// exactly as written.
+func EvalAuthCert(s sexprs.Sexp) (c AuthCert, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) < 4 || !certAtom.Equal(l[0]) {
+		return c, fmt.Errorf("Certificate must be of the form (cert (issuer PRINCIPAL) (subject SUBJECT) (delegate N?)? TAG VALID?)")
+	}
+	issuer, ok := l[1].(sexprs.List)
+	if !ok || len(issuer) != 2 || !issuerAtom.Equal(issuer[0]) {
+		return c, fmt.Errorf("Certificate issuer must be of the form (issuer PRINCIPAL)")
+	}
+	if il, ok := issuer[1].(sexprs.List); (ok && len(il) > 0 && nameAtom.Equal(il[0])) || selfAtom.Equal(issuer[1]) {
+		name, err := EvalName(issuer[1])
+		if err != nil {
+			return AuthCert{}, err
+		}
+		c.Issuer = *name
+	} else {
+		c.Issuer.Principal, err = evalPrincipal(issuer[1])
+		if err != nil {
+			return AuthCert{}, err
+		}
+	}
+	subject, ok := l[2].(sexprs.List)
+	if !ok || len(subject) != 2 || !subjectAtom.Equal(subject[0]) {
+		return AuthCert{}, fmt.Errorf("Certificate subject must be of the form (subject SUBJECT)")
+	}
+	c.Subject, err = evalSubject(subject[1])
+	if err != nil {
+		return AuthCert{}, err
+	}
+	rest := l[3:]
+	if dl, ok := rest[0].(sexprs.List); ok && len(dl) > 0 && delegateAtom.Equal(dl[0]) {
+		c.Delegate = true
+		switch len(dl) {
+		case 1:
+		case 2:
+			n, ok := dl[1].(sexprs.Atom)
+			if ok {
+				c.Depth, err = strconv.Atoi(string(n.Value))
+			}
+			if !ok || err != nil || c.Depth < 1 {
+				return AuthCert{}, fmt.Errorf("Delegation depth must be a positive integer")
+			}
+		default:
+			return AuthCert{}, fmt.Errorf("Delegation must be of the form (delegate N?)")
+		}
+		rest = rest[1:]
+	}
+	if len(rest) == 0 || len(rest) > 2 {
+		return AuthCert{}, fmt.Errorf("Certificate must have a tag and an optional validity")
+	}
+	c.Tag = rest[0]
+	if len(rest) == 2 {
+		v, err := EvalValid(rest[1])
+		if err != nil {
+			return AuthCert{}, err
+		}
+		c.Valid = &v
+	}
+	c.Expr = s
+	return c, nil
+}
+
+// subjectEqual returns true if a & b have the same subject.  A key is
+// the same subject whether it is written in full or as its hash.
+func subjectEqual(a, b *AuthCert) bool {
+	if sexpEqual(subjectSexp(a.Subject), subjectSexp(b.Subject)) {
+		return true
+	}
+	ak, aOK := a.SubjectKey()
+	bk, bOK := b.SubjectKey()
+	return aOK && bOK && ak.Equal(bk)
+}
+
+func subjectSexp(s Subject) sexprs.Sexp {
+	if s == nil {
+		return nil
+	}
+	return s.Subject()
+}
+
+// sexpEqual is like a.Equal(b), but copes with nil S-expressions.
+func sexpEqual(a, b sexprs.Sexp) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
@@ -0,0 +1,193 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"fmt"
+	"github.com/eadmund/sexprs"
+	"time"
+)
+
+// Authorize returns true if the certificates in seq grant tag from root
+// to subject at the instant at.  Every signature in seq must verify
+// (see Sequence.Verify), and only those certificates in seq signed by
+// their own issuers are considered.  Of those, Authorize looks for a
+// chain from root to subject of certificates each valid at at, which
+// Reduce reduces to an authorisation including all of tag.
+//
+// Self, as the issuer of a certificate, stands for root: such a
+// certificate is considered only if root signed it.
+//
+// Online tests are not performed: Authorize returns an error if the
+// only chains it finds require them, so that the caller may reduce the
+// chain itself and check them with Valid.CheckOnline.
+func Authorize(seq Sequence, root Key, subject Subject, tag sexprs.Sexp, at time.Time) (bool, error) {
+	if root == nil || subject == nil {
+		return false, fmt.Errorf("Authorization requires a root and a subject")
+	}
+	// each signature is verified once, for both the sequence's
+	// validity and which certificates it covers
+	v := seq.verify()
+	if err := v.err(); err != nil {
+		return false, err
+	}
+	var certs []*AuthCert
+	coverage := v.coverage()
+	for i, elt := range seq {
+		var cert *AuthCert
+		switch c := elt.(type) {
+		case AuthCert:
+			cert = &c
+		case *AuthCert:
+			cert = c
+		default:
+			continue
+		}
+		if cert.Issuer.IsSelf() {
+			cert = cert.resolveSelf(root)
+		}
+		if cert.Issuer.IsPrincipal() && signedBy(coverage[i], cert.Issuer.Principal) && (cert.Valid == nil || cert.Valid.Contains(at)) {
+			certs = append(certs, cert)
+		}
+	}
+	a := authorizer{certs: certs, subject: subject, tag: tag, explored: make(map[string]bool)}
+	a.search(root, nil, nil)
+	if a.err != nil {
+		return false, a.err
+	}
+	return a.authorized, nil
+}
+
+// resolveSelf returns a copy of c issued by self in place of Self.
+func (c *AuthCert) resolveSelf(self Key) *AuthCert {
+	resolved := *c
+	resolved.Issuer = *c.Issuer.ResolveSelf(self)
+	resolved.Expr = nil
+	return &resolved
+}
+
+// signedBy returns true if k is among signers.
+func signedBy(signers []Key, k Key) bool {
+	for _, signer := range signers {
+		if k.Equal(signer) {
+			return true
+		}
+	}
+	return false
+}
+
+// An authorizer searches a set of certificates for a chain which
+// authorises its subject for its tag.
+type authorizer struct {
+	certs      []*AuthCert
+	subject    Subject
+	tag        sexprs.Sexp
+	authorized bool
+	err        error           // why the first chain found did not authorise
+	explored   map[string]bool // reductions of the chains already extended
+}
+
+// search extends chain, issued ultimately by root and which reduces to
+// reduced, with each certificate issued by issuer which is not already
+// in it, stopping once a chain authorises a.subject for a.tag.
+//
+// What may follow a chain depends only upon its reduction: its final
+// subject, remaining delegation depth, tag & validity.  Each reduction
+// is therefore extended only once, however many chains lead to it, so
+// that certificates which share issuers cannot make the search take
+// exponential time.
+func (a *authorizer) search(issuer Key, chain []*AuthCert, reduced *AuthCert) {
+	if reduced != nil {
+		key := string(Canonicalize(reduced.Sexp()))
+		if a.explored[key] {
+			return
+		}
+		a.explored[key] = true
+	}
+	for _, cert := range a.certs {
+		if a.authorized {
+			return
+		}
+		if inChain(chain, cert) || !cert.Issuer.Principal.Equal(issuer) {
+			continue
+		}
+		extended := append(chain[:len(chain):len(chain)], cert)
+		next, err := extendReduction(reduced, cert)
+		if subjectMatches(cert, a.subject) {
+			a.check(extended, next, err)
+		}
+		if err != nil {
+			continue
+		}
+		if k, ok := cert.SubjectKey(); ok && !a.authorized {
+			a.search(k, extended, next)
+		}
+	}
+}
+
+// extendReduction returns the reduction of a chain which reduces to
+// reduced, extended by cert; if reduced is nil, the chain is just cert.
+func extendReduction(reduced, cert *AuthCert) (*AuthCert, error) {
+	if reduced == nil {
+		return Reduce([]*AuthCert{cert})
+	}
+	return Reduce([]*AuthCert{reduced, cert})
+}
+
+// check notes whether result, the reduction of chain, authorises
+// a.tag, or if chain does not reduce, err, why not.  Only the first
+// failure is kept, so that the chains tried after it do not hide it.
+func (a *authorizer) check(chain []*AuthCert, result *AuthCert, err error) {
+	if err != nil {
+		// report the failure in terms of the whole chain
+		if _, chainErr := Reduce(chain); chainErr != nil {
+			err = chainErr
+		}
+		a.fail(err)
+		return
+	}
+	contains, err := tagContains(result.Tag, a.tag)
+	if err != nil {
+		a.fail(err)
+		return
+	}
+	if !contains {
+		return
+	}
+	if result.Valid != nil && result.Valid.RequiresOnlineCheck() {
+		a.fail(fmt.Errorf("Authorization requires online checks"))
+		return
+	}
+	a.authorized, a.err = true, nil
+}
+
+// fail records err as the reason for a's failure, unless an earlier
+// chain has already failed.
+func (a *authorizer) fail(err error) {
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+func inChain(chain []*AuthCert, cert *AuthCert) bool {
+	for _, c := range chain {
+		if c == cert {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectMatches returns true if cert's subject is s, or, if s is a
+// key, the hash of it.
+func subjectMatches(cert *AuthCert, s Subject) bool {
+	if ks, ok := s.(KeySubject); ok && ks.Key != nil {
+		return cert.subjectIs(ks.Key)
+	}
+	if k, ok := s.(Key); ok {
+		return cert.subjectIs(k)
+	}
+	return sexpEqual(subjectSexp(cert.Subject), s.Subject())
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// A CertCache remembers the results of verifying or reducing
+// certificate sequences, so that a sequence seen again need not be
+// processed again.  Sequences are identified by the SHA-256 hash of
+// their canonical form, which omits display hints: sequences differing
+// only in their hints are equivalent, since hints are not signed and
+// tags are compared without them.  Once it holds its maximum number of
+// results, a CertCache evicts the least-recently-used.  It is safe for
+// concurrent use.
+type CertCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // most-recently-used first
+}
+
+type cacheEntry struct {
+	key    [sha256.Size]byte
+	result interface{}
+}
+
+// NewCertCache returns an empty CertCache holding at most size results.
+func NewCertCache(size int) *CertCache {
+	return &CertCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the result stored for seq, if any.
+func (c *CertCache) Get(seq Sequence) (result interface{}, ok bool) {
+	key := sha256.Sum256(Canonicalize(seq.Sexp()))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elt, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elt)
+	return elt.Value.(*cacheEntry).result, true
+}
+
+// Put stores result as the result for seq, evicting the
+// least-recently-used result if the cache is full.  Results for
+// sequences containing a certificate which is not Cacheable are not
+// stored.
+func (c *CertCache) Put(seq Sequence, result interface{}) {
+	if !cacheable(seq) {
+		return
+	}
+	key := sha256.Sum256(Canonicalize(seq.Sexp()))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.entries[key]; ok {
+		elt.Value.(*cacheEntry).result = result
+		c.order.MoveToFront(elt)
+		return
+	}
+	if c.size <= 0 {
+		return
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, result})
+}
+
+// cacheable returns false if any of the certificates in seq has a
+// one-time validity.
+func cacheable(seq Sequence) bool {
+	for _, elt := range seq {
+		switch cert := elt.(type) {
+		case AuthCert:
+			if !cert.Cacheable() {
+				return false
+			}
+		case *AuthCert:
+			if !cert.Cacheable() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Len returns the number of results in the cache.
+func (c *CertCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -4,11 +4,19 @@ import (
 	"github.com/eadmund/sexprs"
 )
 
+// A Cert is an SPKI certificate.  Every Cert is also a
+// SequenceElement, so that it may be placed in a Sequence alongside
+// the signatures which validate it.
 type Cert interface {
-	Sexp() sexprs.Sexp
-	String() string
-	// above same as Sexp
+	SequenceElement
+	// Certificate returns the same S-expression as Sexp.
 	Certificate() sexprs.Sexp
-	SequenceElement() sexprs.Sexp // every Certificate must be a SequenceElement
 }
 
+var (
+	_ Cert            = AuthCert{}
+	_ Cert            = (*AuthCert)(nil)
+	_ Cert            = NameCert{}
+	_ Cert            = (*NameCert)(nil)
+	_ SequenceElement = (*Signature)(nil)
+)
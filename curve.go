@@ -0,0 +1,95 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A curveInfo records what the package knows about an ECDSA curve: its
+// SPKI name, its implementation and the hash algorithm used when
+// signing with it.
+type curveInfo struct {
+	Name          string
+	Curve         elliptic.Curve
+	HashAlgorithm string
+}
+
+var (
+	curvesMu sync.RWMutex
+	// curves maps SPKI curve names, e.g. "p256", to their curves.
+	curves = map[string]curveInfo{
+		"p256": {"p256", elliptic.P256(), "sha256"},
+		"p384": {"p384", elliptic.P384(), "sha384"},
+	}
+)
+
+// RegisterCurve makes an ECDSA curve available under the SPKI curve
+// name name, e.g. "secp256k1", for use in keys of the form
+//
+//	(public-key (ecdsa-sha2 (curve NAME) (x |...|) (y |...|)))
+//
+// Signatures made with keys on curve use hashAlgorithm, which must be
+// one of KnownHashes.  Curves which are not part of the standard
+// library are registered this way so that the package itself need not
+// depend upon their implementations.
+func RegisterCurve(name string, curve elliptic.Curve, hashAlgorithm string) {
+	curvesMu.Lock()
+	defer curvesMu.Unlock()
+	curves[name] = curveInfo{name, curve, hashAlgorithm}
+}
+
+// curveByName returns the registered curve with the SPKI name name.
+func curveByName(name string) (c curveInfo, ok bool) {
+	curvesMu.RLock()
+	defer curvesMu.RUnlock()
+	c, ok = curves[name]
+	return c, ok
+}
+
+// curveOf returns the registration of curve, if any.
+func curveOf(curve elliptic.Curve) (c curveInfo, ok bool) {
+	curvesMu.RLock()
+	defer curvesMu.RUnlock()
+	for _, c = range curves {
+		if c.Curve == curve {
+			return c, true
+		}
+	}
+	return curveInfo{}, false
+}
+
+// curveNames returns the sorted names of all registered curves.
+func curveNames() (names []string) {
+	curvesMu.RLock()
+	defer curvesMu.RUnlock()
+	for name := range curves {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// An UnsupportedCurveError is returned when a key is on, or an
+// S-expression names, a curve which has not been registered.
+type UnsupportedCurveError struct {
+	Curve string // the name of the curve, if it has one
+}
+
+func (e UnsupportedCurveError) Error() string {
+	return fmt.Sprintf("Unsupported curve %q; curve must be one of %s", e.Curve, strings.Join(curveNames(), ", "))
+}
+
+// unsupportedCurve returns an UnsupportedCurveError for curve.
+func unsupportedCurve(curve elliptic.Curve) UnsupportedCurveError {
+	if curve == nil || curve.Params() == nil {
+		return UnsupportedCurveError{}
+	}
+	return UnsupportedCurveError{curve.Params().Name}
+}
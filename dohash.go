@@ -0,0 +1,79 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"fmt"
+	"github.com/eadmund/sexprs"
+)
+
+var doAtom = sexprs.Atom{Value: []byte("do")}
+
+// EvalDoHash returns the hash algorithm named by the directive
+// (do hash ALGORITHM), which must be known.
+func EvalDoHash(s sexprs.Sexp) (algorithm string, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) != 3 || !doAtom.Equal(l[0]) || !hashAtom.Equal(l[1]) {
+		return "", fmt.Errorf("Hash directive must be of the form (do hash ALGORITHM)")
+	}
+	a, ok := l[2].(sexprs.Atom)
+	if !ok {
+		return "", fmt.Errorf("Hash directive algorithm must be a byte-string")
+	}
+	if !validHash(a.Value) {
+		return "", fmt.Errorf("Unknown hash algorithm %s", a.Value)
+	}
+	return string(a.Value), nil
+}
+
+// DoHash returns the Hash of object under the algorithm named by the
+// directive (do hash ALGORITHM).
+func DoHash(directive, object sexprs.Sexp) (Hash, error) {
+	algorithm, err := EvalDoHash(directive)
+	if err != nil {
+		return Hash{}, err
+	}
+	return HashSexp(algorithm, object)
+}
+
+// hashTagObjects returns tag with each expression of the form
+// (do hash ALGORITHM OBJECT) replaced by the Hash of OBJECT under
+// ALGORITHM.  This lets a request carry the argument of an operation
+// which a certificate's tag authorises by the argument's hash, e.g.
+//    (read (do hash sha256 |...file contents...|))
+// is within
+//    (read (hash sha256 |...digest...|))
+// It returns tag itself if it contains no such expressions.  Other
+// lists beginning with do, such as (do backup), are ordinary tags.
+func hashTagObjects(tag sexprs.Sexp) (sexprs.Sexp, error) {
+	l, ok := tag.(sexprs.List)
+	if !ok {
+		return tag, nil
+	}
+	if len(l) == 4 && doAtom.Equal(l[0]) && hashAtom.Equal(l[1]) {
+		h, err := DoHash(l[:3], l[3])
+		if err != nil {
+			return nil, err
+		}
+		return h.Sexp(), nil
+	}
+	var result sexprs.List
+	for i, elt := range l {
+		t, err := hashTagObjects(elt)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil && !sexpEqual(t, elt) {
+			result = append(sexprs.List{}, l[:i]...)
+		}
+		if result != nil {
+			result = append(result, t)
+		}
+	}
+	if result == nil {
+		return tag, nil
+	}
+	return result, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/eadmund/sexprs"
+	"io"
+	"os"
+)
+
+var sequenceAtom = sexprs.Atom{Value: []byte("sequence")}
+
+// Eval converts any SPKI object S-expression to the corresponding
+// type, according to its leading atom:
+//
+//	hash         Hash
+//	public-key   *PublicKey or *RSAPublicKey
+//	private-key  *PrivateKey or *RSAPrivateKey
+//	signature    *Signature or *RSASignature
+//	cert         AuthCert or NameCert
+//	sequence     Sequence
+//	name         *Name
+//	valid        Valid
+//
+// lookup is used to find the keys of signatures whose principals are
+// hashes, as for EvalSignature.  A certificate with neither a tag nor
+// a delegation is a NameCert.
+func Eval(s sexprs.Sexp, lookup func(Hash) *PublicKey) (interface{}, error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) == 0 {
+		return nil, fmt.Errorf("SPKI object must be a non-empty list")
+	}
+	first, ok := l[0].(sexprs.Atom)
+	if !ok {
+		return nil, fmt.Errorf("SPKI object must start with an atom")
+	}
+	switch {
+	case hashAtom.Equal(first):
+		return EvalHash(l)
+	case publicKeyAtom.Equal(first):
+		if isRSAKey(l) {
+			return EvalRSAPublicKey(l)
+		}
+		return EvalPublicKey(l)
+	case privateKeyAtom.Equal(first):
+		if isRSAKey(l) {
+			return EvalRSAPrivateKey(l)
+		}
+		k, err := EvalPrivateKey(l)
+		if err != nil {
+			return nil, err
+		}
+		return &k, nil
+	case signatureAtom.Equal(first):
+		if isRSASignature(l) {
+			return EvalRSASignature(l)
+		}
+		return EvalSignature(l, lookup)
+	case certAtom.Equal(first):
+		if isNameCert(l) {
+			return EvalNameCert(l)
+		}
+		return EvalAuthCert(l)
+	case sequenceAtom.Equal(first):
+		return EvalSequence(l, lookup)
+	case nameAtom.Equal(first):
+		return EvalName(l)
+	case validAtom.Equal(first):
+		return EvalValid(l)
+	}
+	return nil, fmt.Errorf("Unknown SPKI object %q", first.Value)
+}
+
+// EvalSequence converts a sequence S-expression,
+// (sequence ELEMENT*), to a Sequence, evaluating each element with
+// Eval.
+func EvalSequence(s sexprs.Sexp, lookup func(Hash) *PublicKey) (seq Sequence, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) == 0 || !sequenceAtom.Equal(l[0]) {
+		return nil, fmt.Errorf("Sequence must be of the form (sequence ELEMENT*)")
+	}
+	for _, elt := range l[1:] {
+		v, err := Eval(elt, lookup)
+		if err != nil {
+			return nil, err
+		}
+		e, ok := v.(SequenceElement)
+		if !ok {
+			return nil, fmt.Errorf("%T cannot be an element of a sequence", v)
+		}
+		seq = append(seq, e)
+	}
+	return seq, nil
+}
+
+// isRSAKey returns true if l is a public or private key whose
+// algorithm is RSA.
+func isRSAKey(l sexprs.List) bool {
+	if len(l) != 2 {
+		return false
+	}
+	terms, ok := l[1].(sexprs.List)
+	return ok && len(terms) > 0 && rsaAtom.Equal(terms[0])
+}
+
+// isNameCert returns true if the certificate l has neither a tag nor a
+// delegation, i.e. is of the form (cert ISSUER SUBJECT VALID?).
+func isNameCert(l sexprs.List) bool {
+	switch len(l) {
+	case 3:
+		return true
+	case 4:
+		v, ok := l[3].(sexprs.List)
+		return ok && len(v) > 0 && validAtom.Equal(v[0])
+	}
+	return false
+}
+
+// ParseReader reads every S-expression from r, in canonical or advanced
+// form, until EOF, and converts each with Eval.  It returns the objects
+// in the order in which they appear.
+func ParseReader(r io.Reader, lookup func(Hash) *PublicKey) ([]interface{}, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var objects []interface{}
+	for rest := bytes.TrimSpace(data); len(rest) > 0; rest = bytes.TrimSpace(rest) {
+		var s sexprs.Sexp
+		s, rest, err = sexprs.Parse(rest)
+		if err != nil {
+			return nil, err
+		}
+		v, err := Eval(s, lookup)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, v)
+	}
+	return objects, nil
+}
+
+// ParseFile reads every SPKI object from the file named path, as
+// ParseReader.
+func ParseFile(path string, lookup func(Hash) *PublicKey) ([]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseReader(f, lookup)
+}
+
+// SafeEval parses the single S-expression data, in canonical or
+// advanced form, and converts it with Eval.  Any panic while doing so
+// is recovered and returned as an error, so SafeEval is the
+// recommended entry point for SPKI objects from untrusted sources: a
+// malformed object cannot crash the process.
+func SafeEval(data []byte, lookup func(Hash) *PublicKey) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			v, err = nil, fmt.Errorf("Invalid SPKI object: %v", r)
+		}
+	}()
+	s, rest, err := sexprs.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, fmt.Errorf("Trailing data after SPKI object")
+	}
+	return Eval(s, lookup)
+}
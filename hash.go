@@ -5,12 +5,20 @@
 package spki
 
 import (
-	"bytes"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha3"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/eadmund/sexprs"
 	"hash"
+	"io"
+	"net/url"
+	"sync"
 )
 
 // A Hash represents the Hash of some value under Algorithm.  It may
@@ -19,18 +27,27 @@ import (
 // these URIs, they really are URLs, as they would be used to locate,
 // not just indicate, the hashed object.
 type Hash struct {
-	Algorithm string // sha224, sha256, sha384 or sha512
+	Algorithm string // e.g. sha256, sha512 or sha3-256
 	Hash      []byte // a byte slice of the appropriate length
 	URIs      URIs   // zero or more associated URIs
 }
 
-// Sexp returns an S-expression representing the Hash h.  Calling
-// s.Pack() will return h's canonical S-expression form.
+// Sexp returns an S-expression representing the Hash h, including its
+// URIs if it has any.  Calling s.Pack() will return h's canonical
+// S-expression form.
 func (h Hash) Sexp() (s sexprs.Sexp) {
-	s = sexprs.List{sexprs.Atom{nil, []byte("hash")},
+	l := sexprs.List{sexprs.Atom{nil, []byte("hash")},
 		sexprs.Atom{nil, []byte(h.Algorithm)},
 		sexprs.Atom{nil, h.Hash}}
-	return s
+	if len(h.URIs) > 0 {
+		l = append(l, h.URIs.Sexp())
+	}
+	return l
+}
+
+// Pack returns h's canonical S-expression form.
+func (h Hash) Pack() []byte {
+	return h.Sexp().Pack()
 }
 
 // String returns h's advanced S-expression form.
@@ -38,27 +55,144 @@ func (h Hash) String() string {
 	return h.Sexp().String()
 }
 
+// Hex returns h's digest in lower-case hexadecimal, as fingerprints are
+// usually displayed.
+func (h Hash) Hex() string {
+	return hex.EncodeToString(h.Hash)
+}
+
+// Base64 returns h's digest in standard, padded base64, as it appears
+// in h's advanced S-expression form.
+func (h Hash) Base64() string {
+	return base64.StdEncoding.EncodeToString(h.Hash)
+}
+
+// ParseHashHex returns the Hash under algorithm whose digest is the
+// hexadecimal string digest.  It returns an error if the algorithm is
+// unknown or the digest is malformed or of the wrong length.
+func ParseHashHex(algorithm, digest string) (Hash, error) {
+	size, ok := HashSize(algorithm)
+	if !ok {
+		return Hash{}, fmt.Errorf("Unknown hash algorithm %q", algorithm)
+	}
+	b, err := hex.DecodeString(digest)
+	if err != nil {
+		return Hash{}, fmt.Errorf("Invalid hexadecimal digest: %s", err)
+	}
+	if len(b) != size {
+		return Hash{}, fmt.Errorf("%s hash must be %d bytes long, not %d", algorithm, size, len(b))
+	}
+	return Hash{Algorithm: algorithm, Hash: b}, nil
+}
+
 // Equal returns true if a & b are equivalent hash values, i.e. if
 // they share the same Algorithm and the same Hash.  It ignores the
-// optional URIs.
+// optional URIs.  The digests are compared in constant time, so that
+// comparing a secret hash does not leak its value through timing.
 func (a Hash) Equal(b Hash) bool {
-	return a.Algorithm == b.Algorithm && bytes.Equal(a.Hash, b.Hash)
+	return a.Algorithm == b.Algorithm && subtle.ConstantTimeCompare(a.Hash, b.Hash) == 1
+}
+
+// hashJSON is the JSON representation of a Hash.  encoding/json
+// encodes its digest in base64.
+type hashJSON struct {
+	Algorithm string   `json:"algorithm"`
+	Hash      []byte   `json:"hash"`
+	URIs      []string `json:"uris,omitempty"`
+}
+
+// MarshalJSON returns h as a JSON object of the form
+//
+//	{"algorithm":"sha256","hash":"<base64>","uris":["http://example.com"]}
+//
+// omitting uris if h has none.  It is a convenience for logging & web
+// APIs; h's S-expression form remains authoritative.
+func (h Hash) MarshalJSON() ([]byte, error) {
+	j := hashJSON{Algorithm: h.Algorithm, Hash: h.Hash}
+	for _, uri := range h.URIs {
+		j.URIs = append(j.URIs, uri.String())
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON sets h from a JSON object as returned by MarshalJSON.
+// It returns an error if the algorithm is unknown or the digest is of
+// the wrong length for it.
+func (h *Hash) UnmarshalJSON(data []byte) error {
+	var j hashJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	size, ok := HashSize(j.Algorithm)
+	if !ok {
+		return fmt.Errorf("Unknown hash algorithm %q", j.Algorithm)
+	}
+	if len(j.Hash) != size {
+		return fmt.Errorf("%s hash must be %d bytes long, not %d", j.Algorithm, size, len(j.Hash))
+	}
+	var uris URIs
+	for _, s := range j.URIs {
+		uri, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		uris = append(uris, uri)
+	}
+	*h = Hash{j.Algorithm, j.Hash, uris}
+	return nil
 }
 
 var (
 	// the atom found at the beginning of a hash S-expression
 	hashAtom = sexprs.Atom{nil, []byte("hash")}
 	// the atom found at the beginning of a uris S-expression
-	urisAtom       = sexprs.Atom{nil, []byte("uris")}
-	publicKeyAtom  = sexprs.Atom{nil, []byte("public-key")}
-	privateKeyAtom = sexprs.Atom{nil, []byte("private-key")}
-	ecdsa256Atom   = sexprs.Atom{nil, []byte("ecdsa-sha2")}
-	ecdsa384Atom   = sexprs.Atom{nil, []byte("ecdsa-sha2")}
+	urisAtom          = sexprs.Atom{nil, []byte("uris")}
+	publicKeyAtom     = sexprs.Atom{nil, []byte("public-key")}
+	privateKeyAtom    = sexprs.Atom{nil, []byte("private-key")}
+	hashAlgorithmAtom = sexprs.Atom{nil, []byte("hash-algorithm")}
+	// SPKI names every ECDSA key algorithm ecdsa-sha2, whatever its
+	// curve and hash; the key's (curve ...) term alone tells them
+	// apart.
+	ecdsaSHA2Atom = sexprs.Atom{nil, []byte("ecdsa-sha2")}
 	// KnownHashes is a map of all known hash names to the associated hash
-	// constructors.
+	// constructors.  Use RegisterHash rather than modifying it
+	// directly.
 	KnownHashes = make(map[string]func() hash.Hash)
+	// hashSizes maps known hash names to their digest lengths.
+	hashSizes = make(map[string]int)
+	// hashesMu guards KnownHashes & hashSizes.
+	hashesMu sync.RWMutex
 )
 
+// RegisterHash makes the hash algorithm name, whose constructor is
+// newHash and whose digests are size bytes long, available for use in
+// Hashes, e.g. to support BLAKE2 or an organisation's own hash.  It is
+// safe to call concurrently with the rest of the package.
+func RegisterHash(name string, newHash func() hash.Hash, size int) {
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+	KnownHashes[name] = newHash
+	hashSizes[name] = size
+}
+
+// knownHash returns the constructor for the hash algorithm name.
+func knownHash(name string) (newHash func() hash.Hash, ok bool) {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+	newHash, ok = KnownHashes[name]
+	return newHash, ok
+}
+
+// knownHashNames returns the names of all known hash algorithms.
+func knownHashNames() (names []string) {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+	for name := range KnownHashes {
+		names = append(names, name)
+	}
+	return names
+}
+
 // EvalHash converts a hash S-expression to its equivalent Hash struct.
 func EvalHash(s sexprs.Sexp) (h Hash, err error) {
 	switch s := s.(type) {
@@ -67,6 +201,10 @@ func EvalHash(s sexprs.Sexp) (h Hash, err error) {
 			algorithm, alg_ok := s[1].(sexprs.Atom)
 			value, val_ok := s[2].(sexprs.Atom)
 			if alg_ok && val_ok && validHash(algorithm.Value) {
+				size, _ := HashSize(string(algorithm.Value))
+				if len(value.Value) != size {
+					return Hash{}, fmt.Errorf("%s hash must be %d bytes long, not %d", algorithm.Value, size, len(value.Value))
+				}
 				h = Hash{string(algorithm.Value),
 					value.Value, nil}
 				if len(s) == 4 {
@@ -82,20 +220,121 @@ func EvalHash(s sexprs.Sexp) (h Hash, err error) {
 	return Hash{}, fmt.Errorf("Invalid hash expression")
 }
 
+// HashObject returns the Hash of data under algorithm, with the
+// optional retrieval URIs uris attached.  It returns an error if the
+// algorithm is unknown or if any of uris cannot be parsed as a URI.
+func HashObject(algorithm string, data []byte, uris ...string) (h Hash, err error) {
+	newHash, ok := knownHash(algorithm)
+	if !ok {
+		return h, fmt.Errorf("Unknown hash algorithm %s", algorithm)
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return Hash{}, err
+		}
+		h.URIs = append(h.URIs, u)
+	}
+	hasher := newHash()
+	_, err = hasher.Write(data)
+	if err != nil {
+		return Hash{}, err
+	}
+	h.Algorithm = algorithm
+	h.Hash = hasher.Sum(nil)
+	return h, nil
+}
+
+// HashReader returns the Hash of everything read from r until EOF under
+// algorithm, hashing it as it is read rather than holding it in memory.
+// This suits large objects, e.g. files located by a hash's URIs.  It
+// returns an error if the algorithm is unknown or r fails.
+func HashReader(algorithm string, r io.Reader) (h Hash, err error) {
+	newHash, ok := knownHash(algorithm)
+	if !ok {
+		return h, fmt.Errorf("Unknown hash algorithm %s", algorithm)
+	}
+	hasher := newHash()
+	_, err = io.Copy(hasher, r)
+	if err != nil {
+		return h, err
+	}
+	h.Algorithm = algorithm
+	h.Hash = hasher.Sum(nil)
+	return h, nil
+}
+
+// HashSexp returns the Hash of the canonical form of s under
+// algorithm, or an error if the algorithm is unknown.
+func HashSexp(algorithm string, s sexprs.Sexp) (Hash, error) {
+	return HashObject(algorithm, Canonicalize(s))
+}
+
+// VerifyObject returns true if data hashes to h under h's algorithm.
+// The digests are compared in constant time.  It returns false if h's
+// algorithm is unknown.
+func (h Hash) VerifyObject(data []byte) bool {
+	h2, err := HashObject(h.Algorithm, data)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(h.Hash, h2.Hash) == 1
+}
+
+// VerifySexp returns true if the canonical form of s hashes to h, as
+// VerifyObject.
+func (h Hash) VerifySexp(s sexprs.Sexp) bool {
+	return h.VerifyObject(Canonicalize(s))
+}
+
 func validHash(b []byte) bool {
-	_, ok := KnownHashes[string(b)]
+	_, ok := knownHash(string(b))
 	return ok
 }
 
+// ValidHashAlgorithm returns true if name is a known hash algorithm,
+// i.e. one which may be used in a Hash.
+func ValidHashAlgorithm(name string) bool {
+	return validHash([]byte(name))
+}
+
+// HashSize returns the length in bytes of a digest under the hash
+// algorithm name, or false if the algorithm is unknown.
+func HashSize(name string) (int, bool) {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+	size, ok := hashSizes[name]
+	if !ok {
+		newHash, ok := KnownHashes[name]
+		if !ok {
+			return 0, false
+		}
+		// added directly to KnownHashes rather than registered
+		return newHash().Size(), true
+	}
+	return size, true
+}
+
+// EnableLegacyHashes makes the legacy hash algorithm sha1 available,
+// for interoperation with older SPKI artifacts which use it.  SHA-1 is
+// broken: collisions can be found in practice, so sha1 hashes must not
+// be relied upon to identify keys or objects, and new hashes should
+// never use it.  It is therefore not available unless this is called.
+func EnableLegacyHashes() {
+	RegisterHash("sha1", sha1.New, sha1.Size)
+}
+
 // A Hash may be used as the subject of a certificate
 func (h Hash) Subject() sexprs.Sexp {
-	fmt.Println("subject for", h)
-	return sexprs.List{sexprs.Atom{Value: []byte("subject")}, h.Sexp()}
+	return h.Sexp()
 }
 
 func init() {
-	KnownHashes["sha256"] = sha256.New
-	KnownHashes["sha224"] = sha256.New224
-	KnownHashes["sha512"] = sha512.New
-	KnownHashes["sha384"] = sha512.New384
+	RegisterHash("sha256", sha256.New, sha256.Size)
+	RegisterHash("sha224", sha256.New224, sha256.Size224)
+	RegisterHash("sha512", sha512.New, sha512.Size)
+	RegisterHash("sha384", sha512.New384, sha512.Size384)
+	RegisterHash("sha3-256", func() hash.Hash { return sha3.New256() }, 32)
+	RegisterHash("sha3-384", func() hash.Hash { return sha3.New384() }, 48)
+	RegisterHash("sha3-512", func() hash.Hash { return sha3.New512() }, 64)
 }
@@ -12,9 +12,12 @@ import (
 type Key interface {
 	// Returns true if the key is just a hash.
 	IsHash() bool
-	// Returns the public key for the key: the key itself, if it's
-	// already a public key; a public version of the key, if it's
-	// a private key; or nil, if it is a hash without a key.
+	// Returns the ECDSA public key for the key: the key itself, if
+	// it's already a public key; a public version of the key, if
+	// it's a private key; or nil, if it has no ECDSA public key.
+	// That is the case both for a hash without a key and for a key
+	// of another kind, such as an RSA key, so use IsHash rather
+	// than a nil result to tell whether a key is just a hash.
 	PublicKey() (*PublicKey)
 	// Returns the hash value of the key under a particular
 	// algorithm, or an error if the key is just a hash and the
@@ -55,11 +58,31 @@ func (h HashKey) Hashed(algorithm string) ([]byte, error) {
 	return hash.Hash, err
 }
 
+// Sexp returns h as a hash S-expression, the same one its Subject
+// method returns, or nil if h has no hashes.  EvalHash converts it
+// back to a Hash.
+func (h HashKey) Sexp() sexprs.Sexp {
+	return h.Subject()
+}
+
+// Pack returns h's canonical S-expression form, or nil if h has no
+// hashes.
+func (h HashKey) Pack() []byte {
+	s := h.Sexp()
+	if s == nil {
+		return nil
+	}
+	return s.Pack()
+}
+
+// String returns h's advanced S-expression form, or the empty string if
+// h has no hashes.
 func (h HashKey) String() string {
-	if len(h.Hashes) == 0 {
+	s := h.Sexp()
+	if s == nil {
 		return ""
 	}
-	return h.Hashes[0].String()
+	return s.String()
 }
 
 func (h HashKey) HashExp(algorithm string) (hh Hash, err error) {
@@ -81,26 +104,58 @@ func (h HashKey) HashAlgorithm() string {
 	return ""
 }
 
-// BUG(eadmund): rather than returning the first stored hash, return
-// the 'best' for some value of.
+// hashPreference lists hash algorithms from strongest to weakest.
+// Algorithms not listed rank below all of those which are.
+var hashPreference = []string{"sha3-512", "sha512", "sha3-384", "sha384", "sha3-256", "sha256", "sha224"}
+
+// hashRank returns algorithm's position in hashPreference, or
+// len(hashPreference) if it is not listed.
+func hashRank(algorithm string) int {
+	for i, name := range hashPreference {
+		if name == algorithm {
+			return i
+		}
+	}
+	return len(hashPreference)
+}
+
+// BestHash returns the strongest of h's hashes, according to the order
+// sha3-512, sha512, sha3-384, sha384, sha3-256, sha256, sha224.  Of
+// hashes equally strong it returns the first.  It returns false if h
+// has no hashes.
+func (h HashKey) BestHash() (best Hash, ok bool) {
+	for _, hash := range h.Hashes {
+		if !ok || hashRank(hash.Algorithm) < hashRank(best.Algorithm) {
+			best, ok = hash, true
+		}
+	}
+	return best, ok
+}
+
+// Subject returns h's strongest hash, as chosen by BestHash, as a hash
+// S-expression, or nil if h has no hashes.
 func (h HashKey) Subject() sexprs.Sexp {
-	if h.Hashes == nil || len(h.Hashes) == 0 {
+	best, ok := h.BestHash()
+	if !ok {
 		return nil
 	}
-	return sexprs.List{sexprs.Atom{Value: []byte("subject")}, h.Hashes[0].Sexp()}
+	return best.Sexp()
 }
 
+// Equal returns true if any of h's hashes is a hash of k under the same
+// algorithm.
 func (h HashKey) Equal(k Key) bool {
-	fmt.Println("hashkey", h.String(), fmt.Sprintf("%#v", h), "key", k.String())
 	if k == nil {
 		return false
 	}
-	for _, hash1 := range h.Hashes {
-		// can never return an error because we know algorithm is good
-		fmt.Println(")", hash1.String())
-		hash2, _ := k.HashExp(hash1.Algorithm)
-		fmt.Println(">", hash2.String())
-		if hash1.Equal(hash2) {
+	return hashKeyMatches(h, k)
+}
+
+// hashKeyMatches returns true if any of hk's hashes is a hash of k.
+func hashKeyMatches(hk HashKey, k Key) bool {
+	for _, h := range hk.Hashes {
+		h2, err := k.HashExp(h.Algorithm)
+		if err == nil && h.Equal(h2) {
 			return true
 		}
 	}
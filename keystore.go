@@ -0,0 +1,61 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"encoding/hex"
+	"sync"
+)
+
+// A KeyStore holds public keys and looks them up by their hashes.  Its
+// Lookup method may be passed as the lookupFunc of EvalSignature and
+// the like.  It is safe for concurrent use.
+type KeyStore struct {
+	mu   sync.RWMutex
+	keys map[keyStoreIndex]*PublicKey
+}
+
+// A keyStoreIndex identifies a key by its hash under an algorithm.
+type keyStoreIndex struct {
+	algorithm, digest string // digest is in hex
+}
+
+// NewKeyStore returns an empty KeyStore.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[keyStoreIndex]*PublicKey)}
+}
+
+// Add adds k to the store, indexed by its hash under each known hash
+// algorithm.  Algorithms registered after k is added do not index it.
+// It returns an UnsupportedCurveError if k's curve is not supported.
+func (ks *KeyStore) Add(k *PublicKey) error {
+	if _, err := k.SexpErr(); err != nil {
+		return err
+	}
+	var indices []keyStoreIndex
+	for _, algorithm := range knownHashNames() {
+		h, err := k.HashExp(algorithm)
+		if err != nil {
+			return err
+		}
+		indices = append(indices, keyStoreIndex{algorithm, hex.EncodeToString(h.Hash)})
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.keys == nil {
+		ks.keys = make(map[keyStoreIndex]*PublicKey)
+	}
+	for _, index := range indices {
+		ks.keys[index] = k
+	}
+	return nil
+}
+
+// Lookup returns the key whose hash is h, or nil if the store has none.
+func (ks *KeyStore) Lookup(h Hash) *PublicKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[keyStoreIndex{h.Algorithm, hex.EncodeToString(h.Hash)}]
+}
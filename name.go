@@ -1,6 +1,7 @@
 package spki
 
 import (
+	"fmt"
 	"github.com/eadmund/sexprs"
 )
 
@@ -36,22 +37,143 @@ func (n *Name) IsLocal() bool {
 	return len(n.Names) < 2
 }
 
-// IsPrefix returns true if n is a prefix of n2
+// IsSelf returns true if n is Self, the principal who is reading or
+// checking a certificate: it has neither a Principal nor any Names, and
+// is written as the atom Self.  A name relative to Self, such as
+// (name Self a), also has a nil Principal but is not Self.
+func (n *Name) IsSelf() bool {
+	return n != nil && n.Principal == nil && len(n.Names) == 0
+}
+
+// IsPrefix returns true if n is a prefix of n2, i.e. if they share the
+// same principal and n's names begin n2's.  A name is a prefix of
+// itself.
 func (n *Name) IsPrefix(n2 *Name) bool {
-	if n == nil {
-		return n2 == nil
+	if n == nil || n2 == nil {
+		return n == n2
+	}
+	switch {
+	case n.Principal == nil || n2.Principal == nil:
+		if n.Principal != nil || n2.Principal != nil {
+			return false
+		}
+	case !n.Principal.Equal(n2.Principal):
+		return false
 	}
-	if n.Principal != nil && !n.Principal.Equal(n2.Principal) {
+	if len(n.Names) > len(n2.Names) {
 		return false
 	}
-	for names1, names2, i := n.Names, n2.Names, 0; i < len(names1) && i < len(names2); i++ {
-		if names1[i] != names2[i] {
+	for i, name := range n.Names {
+		if name != n2.Names[i] {
 			return false
 		}
 	}
 	return true
 }
 
+// Append returns a new name extending n with the local name name, e.g.
+// (name KEY a b) for (name KEY a) and b.  n itself is not changed, and
+// the new name shares no storage with it.
+func (n *Name) Append(name string) *Name {
+	return n.Extend(name)
+}
+
+// Extend returns a new name extending n with names in turn, e.g.
+// (name KEY a b c) for KEY's principal name and a, b & c.  As with
+// Append, n itself is not changed.  A nil n is taken to be Self.
+func (n *Name) Extend(names ...string) *Name {
+	n2 := new(Name)
+	if n != nil {
+		n2.Principal = n.Principal
+		n2.Names = make([]string, 0, len(n.Names)+len(names))
+		n2.Names = append(n2.Names, n.Names...)
+	}
+	n2.Names = append(n2.Names, names...)
+	return n2
+}
+
+// ResolveSelf returns n with the key self standing in for Self, i.e.
+// for a nil Principal.  Names with a principal are returned unchanged.
+func (n *Name) ResolveSelf(self Key) *Name {
+	if n == nil || n.Principal != nil {
+		return n
+	}
+	return &Name{self, n.Names}
+}
+
+// MaxNameDepth is the greatest number of steps Resolve will take in
+// resolving a single name.
+const MaxNameDepth = 32
+
+// Resolve returns the principals which the extended name n denotes.
+// lookup is called with local names, e.g. (name KEY a), and should
+// return the names to which name certificates bind them; each may be a
+// principal or another name.  Thus (name KEY a b) is resolved by
+// looking up (name KEY a) and then the b of each of the names it maps
+// to, and so on.  Names which refer back to themselves are ignored.
+// Resolve returns an error if n is relative to Self, for which see
+// ResolveSelf, or if resolution takes more than MaxNameDepth steps.
+func (n *Name) Resolve(lookup func(*Name) []*Name) ([]*Name, error) {
+	r := nameResolver{
+		lookup:   lookup,
+		visiting: make(map[string]bool),
+		resolved: make(map[string]bool),
+	}
+	if err := r.resolve(n, 0); err != nil {
+		return nil, err
+	}
+	return r.principals, nil
+}
+
+// A nameResolver resolves names for a single call of Name.Resolve.
+type nameResolver struct {
+	lookup     func(*Name) []*Name
+	visiting   map[string]bool // names being resolved, to break cycles
+	resolved   map[string]bool // names whose principals are found
+	principals []*Name
+}
+
+// resolve adds the principals n denotes to r.principals.  Each name is
+// resolved only once, however many paths lead to it, so that names
+// which share sub-names cannot make resolution take exponential time.
+func (r *nameResolver) resolve(n *Name, depth int) error {
+	if n == nil {
+		return fmt.Errorf("Cannot resolve a nil name")
+	}
+	if n.Principal == nil {
+		return fmt.Errorf("Cannot resolve %s relative to Self", n)
+	}
+	if n.IsPrincipal() {
+		for _, p := range r.principals {
+			if p.Principal.Equal(n.Principal) {
+				return nil
+			}
+		}
+		r.principals = append(r.principals, n)
+		return nil
+	}
+	if depth >= MaxNameDepth {
+		return fmt.Errorf("Name %s is more than %d steps deep", n, MaxNameDepth)
+	}
+	key := n.String()
+	if r.visiting[key] || r.resolved[key] {
+		return nil
+	}
+	r.visiting[key] = true
+	defer delete(r.visiting, key)
+	for _, target := range r.lookup(n.Local()) {
+		if target == nil {
+			continue
+		}
+		names := append(append([]string(nil), target.Names...), n.Names[1:]...)
+		if err := r.resolve(&Name{target.Principal, names}, depth+1); err != nil {
+			return err
+		}
+	}
+	r.resolved[key] = true
+	return nil
+}
+
 func (n *Name) Sexp() sexprs.Sexp {
 	if n == nil {
 		return nil
@@ -60,7 +182,7 @@ func (n *Name) Sexp() sexprs.Sexp {
 	if n.Principal != nil {
 		issuerSexp = n.Principal.Sexp()
 	} else {
-		issuerSexp = sexprs.Atom{Value: []byte("Self")}
+		issuerSexp = selfAtom
 	}
 	if len(n.Names) == 0 {
 		return issuerSexp
@@ -72,10 +194,17 @@ func (n *Name) Sexp() sexprs.Sexp {
 	return append(sexprs.List{sexprs.Atom{Value: []byte("name")}, issuerSexp}, names...)
 }
 
+// Equal returns true if n & n2 are the same name: the same names
+// relative to the same principal.  Names relative to Self, i.e. with
+// nil principals, are equal only to each other.
 func (n *Name) Equal(n2 Name) bool {
 	switch {
 	case n == nil:
 		return false
+	case n.Principal == nil || n2.Principal == nil:
+		if n.Principal != nil || n2.Principal != nil {
+			return false
+		}
 	case !n.Principal.Equal(n2.Principal):
 		return false
 	}
@@ -87,6 +216,17 @@ func (n *Name) Equal(n2 Name) bool {
 	return len(n.Names) == len(n2.Names)
 }
 
+// A Name may be the subject of a certificate, e.g. of a name
+// certificate defining one name in terms of another.
+func (n *Name) Subject() sexprs.Sexp {
+	return n.Sexp()
+}
+
+// Pack returns n's canonical S-expression form.
+func (n *Name) Pack() []byte {
+	return n.Sexp().Pack()
+}
+
 func (n *Name) String() string {
 	return n.Sexp().String()
 }
\ No newline at end of file
@@ -0,0 +1,190 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"fmt"
+	"github.com/eadmund/sexprs"
+)
+
+var (
+	certAtom    = sexprs.Atom{Value: []byte("cert")}
+	issuerAtom  = sexprs.Atom{Value: []byte("issuer")}
+	subjectAtom = sexprs.Atom{Value: []byte("subject")}
+	nameAtom    = sexprs.Atom{Value: []byte("name")}
+	selfAtom    = sexprs.Atom{Value: []byte("Self")}
+)
+
+// A NameCert binds a local name in its issuer's namespace to a
+// subject, which may be a key, a hash or another name.  It looks like:
+//    (cert (issuer (name PRINCIPAL NAME)) (subject SUBJECT) VALID?)
+// Unlike an AuthCert it has neither a tag nor a delegation flag: a
+// name passes on everything the name is granted to its subject.
+type NameCert struct {
+	Expr    sexprs.Sexp // the originally-parsed S-expression, for hashing
+	Issuer  Name        // a principal & exactly one name
+	Subject Subject
+	Valid   *Valid
+}
+
+func (c NameCert) Certificate() sexprs.Sexp {
+	return c.Sexp()
+}
+
+func (c NameCert) Sexp() sexprs.Sexp {
+	if c.Expr != nil {
+		return c.Expr
+	}
+	s := sexprs.List{certAtom,
+		sexprs.List{issuerAtom, c.Issuer.Sexp()},
+		sexprs.List{subjectAtom, subjectSexp(c.Subject)}}
+	if c.Valid != nil {
+		if vs := c.Valid.Sexp(); vs != nil {
+			s = append(s, vs)
+		}
+	}
+	return s
+}
+
+// Pack returns c's canonical S-expression form.
+func (c NameCert) Pack() []byte {
+	return c.Sexp().Pack()
+}
+
+func (c NameCert) String() string {
+	return c.Sexp().String()
+}
+
+// EvalNameCert converts a name certificate S-expression to a NameCert.
+// A subject which is a hash is returned as a Hash, a public key as a
+// KeySubject and a name as a *Name.  As with EvalAuthCert, the returned
+// certificate's Expr is s, so that it hashes & verifies exactly as
+// written.
+func EvalNameCert(s sexprs.Sexp) (c NameCert, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) < 3 || len(l) > 4 || !certAtom.Equal(l[0]) {
+		return c, fmt.Errorf("Name certificate must be of the form (cert (issuer (name PRINCIPAL NAME)) (subject SUBJECT) VALID?)")
+	}
+	issuer, ok := l[1].(sexprs.List)
+	if !ok || len(issuer) != 2 || !issuerAtom.Equal(issuer[0]) {
+		return c, fmt.Errorf("Name certificate issuer must be of the form (issuer (name PRINCIPAL NAME))")
+	}
+	name, err := EvalName(issuer[1])
+	if err != nil {
+		return NameCert{}, err
+	}
+	if name.Principal == nil || len(name.Names) != 1 {
+		return NameCert{}, fmt.Errorf("Name certificate issuer must be of the form (issuer (name PRINCIPAL NAME))")
+	}
+	c.Issuer = *name
+	subject, ok := l[2].(sexprs.List)
+	if !ok || len(subject) != 2 || !subjectAtom.Equal(subject[0]) {
+		return NameCert{}, fmt.Errorf("Name certificate subject must be of the form (subject SUBJECT)")
+	}
+	c.Subject, err = evalSubject(subject[1])
+	if err != nil {
+		return NameCert{}, err
+	}
+	if len(l) == 4 {
+		v, err := EvalValid(l[3])
+		if err != nil {
+			return NameCert{}, err
+		}
+		c.Valid = &v
+	}
+	c.Expr = s
+	return c, nil
+}
+
+// EvalName converts a name S-expression, (name PRINCIPAL NAME*) or the
+// relative (name NAME+), to a Name.  A relative name has a nil
+// Principal, i.e. it is relative to Self.  The bare atom Self is
+// converted to the Name for which IsSelf is true.
+func EvalName(s sexprs.Sexp) (n *Name, err error) {
+	if selfAtom.Equal(s) {
+		return &Name{}, nil
+	}
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) < 2 || !nameAtom.Equal(l[0]) {
+		return nil, fmt.Errorf("Name must be of the form (name PRINCIPAL NAME*)")
+	}
+	n = new(Name)
+	names := l[1:]
+	switch {
+	case selfAtom.Equal(l[1]):
+		names = l[2:]
+	case sexprs.IsList(l[1]):
+		n.Principal, err = evalPrincipal(l[1])
+		if err != nil {
+			return nil, err
+		}
+		names = l[2:]
+	}
+	for _, name := range names {
+		a, ok := name.(sexprs.Atom)
+		if !ok {
+			return nil, fmt.Errorf("Names must be atoms")
+		}
+		n.Names = append(n.Names, string(a.Value))
+	}
+	if n.Principal == nil && len(n.Names) == 0 {
+		return nil, fmt.Errorf("Relative name must have at least one name")
+	}
+	return n, nil
+}
+
+// evalSubject converts a subject object, i.e. a hash, a public key or a
+// name, to a Subject.  A public key, whether ECDSA or RSA, is returned as
+// a KeySubject, so that it is written out in full again rather than as
+// its hash.
+func evalSubject(s sexprs.Sexp) (Subject, error) {
+	l, ok := s.(sexprs.List)
+	if ok && len(l) > 0 {
+		switch {
+		case hashAtom.Equal(l[0]):
+			return EvalHash(l)
+		case publicKeyAtom.Equal(l[0]):
+			var k Key
+			var err error
+			if isRSAKey(l) {
+				k, err = EvalRSAPublicKey(l)
+			} else {
+				k, err = EvalPublicKey(l)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return KeySubject{k}, nil
+		case nameAtom.Equal(l[0]):
+			return EvalName(l)
+		}
+	}
+	return nil, fmt.Errorf("Subject must be a hash, a public key or a name")
+}
+
+// NameCertLookup returns a function suitable for Name.Resolve which
+// looks local names up in certs.  A subject name relative to Self, e.g.
+// (subject (name bob)), is taken to be relative to its certificate's
+// issuer, i.e. to name the issuer's bob.
+func NameCertLookup(certs []NameCert) func(*Name) []*Name {
+	return func(n *Name) (names []*Name) {
+		for _, c := range certs {
+			if !c.Issuer.Equal(*n) {
+				continue
+			}
+			switch subject := c.Subject.(type) {
+			case *Name:
+				names = append(names, subject.ResolveSelf(c.Issuer.Principal))
+			case Key:
+				names = append(names, &Name{Principal: subject})
+			case KeySubject:
+				names = append(names, &Name{Principal: subject.Key})
+			case Hash:
+				names = append(names, &Name{Principal: HashKey{[]Hash{subject}}})
+			}
+		}
+		return names
+	}
+}
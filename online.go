@@ -0,0 +1,126 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"fmt"
+	"github.com/eadmund/sexprs"
+)
+
+var (
+	onlineAtom = sexprs.Atom{Value: []byte("online")}
+	idAtom     = sexprs.Atom{Value: []byte("id")}
+)
+
+// An OnlineTest is a check which must be made online, e.g. against a
+// certificate revocation list, before a certificate may be trusted.
+// It looks like:
+//    (online TYPE (uris ...) PRINCIPAL (id ID) S-PART*)
+// where TYPE is one of crl, reval or one-time and PRINCIPAL is the key
+// which signs the test's results, or:
+//    (online new-cert (uris ...))
+type OnlineTest struct {
+	Type      string        // crl, reval, one-time or new-cert
+	URIs      URIs          // where the test's results may be fetched
+	Principal Key           // the signer of the test's results; nil for new-cert
+	ID        []byte        // the test's identifier; nil for new-cert
+	Parts     []sexprs.Sexp // any further parameters of the test
+}
+
+// An OnlineChecker performs the online test t, returning true if it
+// passes.  The package itself never makes network requests; callers
+// supply an OnlineChecker to Valid.CheckOnline.
+type OnlineChecker func(t OnlineTest) (bool, error)
+
+// EvalOnlineTest converts an online test S-expression to an
+// OnlineTest.
+func EvalOnlineTest(s sexprs.Sexp) (t OnlineTest, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) < 3 || !onlineAtom.Equal(l[0]) {
+		return t, fmt.Errorf("Online test must be of the form (online TYPE (uris ...) PRINCIPAL (id ID) S-PART*)")
+	}
+	typ, ok := l[1].(sexprs.Atom)
+	if !ok {
+		return t, fmt.Errorf("Online test type must be an atom")
+	}
+	t.Type = string(typ.Value)
+	t.URIs, err = EvalURIs(l[2])
+	if err != nil {
+		return OnlineTest{}, err
+	}
+	switch t.Type {
+	case "new-cert":
+		if len(l) != 3 {
+			return OnlineTest{}, fmt.Errorf("Online test must be of the form (online new-cert (uris ...))")
+		}
+		return t, nil
+	case "crl", "reval", "one-time":
+	default:
+		return OnlineTest{}, fmt.Errorf("Unknown online test type %s", t.Type)
+	}
+	if len(l) < 5 {
+		return OnlineTest{}, fmt.Errorf("Online test must be of the form (online TYPE (uris ...) PRINCIPAL (id ID) S-PART*)")
+	}
+	t.Principal, err = evalPrincipal(l[3])
+	if err != nil {
+		return OnlineTest{}, err
+	}
+	id, ok := l[4].(sexprs.List)
+	if !ok || len(id) != 2 || !idAtom.Equal(id[0]) {
+		return OnlineTest{}, fmt.Errorf("Online test ID must be of the form (id ID)")
+	}
+	idValue, ok := id[1].(sexprs.Atom)
+	if !ok {
+		return OnlineTest{}, fmt.Errorf("Online test ID must be an atom")
+	}
+	t.ID = idValue.Value
+	t.Parts = append([]sexprs.Sexp(nil), l[5:]...)
+	return t, nil
+}
+
+// evalPrincipal converts a principal, i.e. a public key or the hash of
+// one, to a Key.
+func evalPrincipal(s sexprs.Sexp) (Key, error) {
+	l, ok := s.(sexprs.List)
+	if ok && len(l) > 0 {
+		switch {
+		case hashAtom.Equal(l[0]):
+			h, err := EvalHash(l)
+			if err != nil {
+				return nil, err
+			}
+			return HashKey{[]Hash{h}}, nil
+		case publicKeyAtom.Equal(l[0]):
+			if isRSAKey(l) {
+				return EvalRSAPublicKey(l)
+			}
+			return EvalPublicKey(l)
+		}
+	}
+	return nil, fmt.Errorf("Principal must be either a hash or a public key")
+}
+
+// Sexp returns t as an S-expression.
+func (t OnlineTest) Sexp() sexprs.Sexp {
+	s := sexprs.List{onlineAtom, sexprs.Atom{Value: []byte(t.Type)}, t.URIs.Sexp()}
+	if t.Type == "new-cert" {
+		return s
+	}
+	var principal sexprs.Sexp
+	if t.Principal != nil {
+		principal = t.Principal.Sexp()
+	}
+	s = append(s, principal, sexprs.List{idAtom, sexprs.Atom{Value: t.ID}})
+	return append(s, t.Parts...)
+}
+
+// Pack returns t's canonical S-expression form.
+func (t OnlineTest) Pack() []byte {
+	return t.Sexp().Pack()
+}
+
+func (t OnlineTest) String() string {
+	return t.Sexp().String()
+}
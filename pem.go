@@ -0,0 +1,66 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"encoding/pem"
+	"fmt"
+	"github.com/eadmund/sexprs"
+)
+
+const (
+	// PublicKeyPEMType is the type of a PEM block holding a public
+	// key's canonical S-expression.
+	PublicKeyPEMType = "SPKI PUBLIC KEY"
+	// PrivateKeyPEMType is the type of a PEM block holding a private
+	// key's canonical S-expression.
+	PrivateKeyPEMType = "SPKI PRIVATE KEY"
+)
+
+// MarshalPEM returns k PEM-encoded, as a PublicKeyPEMType block whose
+// contents are k's canonical S-expression.
+func (k *PublicKey) MarshalPEM() ([]byte, error) {
+	s, err := k.SexpErr()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PublicKeyPEMType, Bytes: Canonicalize(s)}), nil
+}
+
+// MarshalPEM returns k PEM-encoded, as a PrivateKeyPEMType block whose
+// contents are k's canonical S-expression.  The result is exactly as
+// secret as k itself.
+func (k *PrivateKey) MarshalPEM() ([]byte, error) {
+	s, err := k.SexpErr()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PrivateKeyPEMType, Bytes: Canonicalize(s)}), nil
+}
+
+// ParsePEM reads the first PEM block in data, which must be a public or
+// private key as written by MarshalPEM.  A public key is returned as a
+// *PublicKey and a private key as a *PrivateKey.
+func ParsePEM(data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM block found")
+	}
+	s, _, err := sexprs.Parse(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case PublicKeyPEMType:
+		return EvalPublicKey(s)
+	case PrivateKeyPEMType:
+		k, err := EvalPrivateKey(s)
+		if err != nil {
+			return nil, err
+		}
+		return &k, nil
+	}
+	return nil, fmt.Errorf("Unknown PEM block type %s", block.Type)
+}
@@ -5,11 +5,17 @@
 package spki
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"fmt"
 	"github.com/eadmund/sexprs"
+	"math/big"
 )
 
 type PrivateKey struct {
@@ -17,8 +23,16 @@ type PrivateKey struct {
 	ecdsa.PrivateKey
 }
 
-// Sexp returns a well-formed S-expression for k
+// Sexp returns a well-formed S-expression for k, or nil if k's curve is
+// not supported; SexpErr reports why.
 func (k *PrivateKey) Sexp() (s sexprs.Sexp) {
+	s, _ = k.SexpErr()
+	return s
+}
+
+// SexpErr returns a well-formed S-expression for k, or an
+// UnsupportedCurveError if k's curve is not supported.
+func (k *PrivateKey) SexpErr() (s sexprs.Sexp, err error) {
 	l := make(sexprs.List, 2)
 	l[0] = sexprs.Atom{Value: []byte("private-key")}
 	ll := make(sexprs.List, 5)
@@ -27,14 +41,11 @@ func (k *PrivateKey) Sexp() (s sexprs.Sexp) {
 	c := make(sexprs.List, 2)
 	ll[1] = c
 	c[0] = sexprs.Atom{Value: []byte("curve")}
-	switch k.Curve {
-	case elliptic.P256():
-		c[1] = sexprs.Atom{Value: []byte("p256")}
-	case elliptic.P384():
-		c[1] = sexprs.Atom{Value: []byte("p384")}
-	default:
-		return nil
+	curve, ok := curveOf(k.Curve)
+	if !ok {
+		return nil, unsupportedCurve(k.Curve)
 	}
+	c[1] = sexprs.Atom{Value: []byte(curve.Name)}
 	x := make(sexprs.List, 2)
 	ll[2] = x
 	x[0] = sexprs.Atom{Value: []byte("x")}
@@ -47,11 +58,15 @@ func (k *PrivateKey) Sexp() (s sexprs.Sexp) {
 	ll[4] = d
 	d[0] = sexprs.Atom{Value: []byte("d")}
 	d[1] = sexprs.Atom{Value: k.D.Bytes()}
-	return l
+	return l, nil
 }
 
 func (k *PrivateKey) Pack() []byte {
-	return k.Sexp().Pack()
+	s := k.Sexp()
+	if s == nil {
+		return nil
+	}
+	return s.Pack()
 }
 
 // Key-specific methods
@@ -76,21 +91,14 @@ func (k *PrivateKey) PublicKey() *PublicKey {
 
 func (k *PrivateKey) HashExp(algorithm string) (hash Hash, err error) {
 	hash, err = k.HashKey.HashExp(algorithm)
-	if err != nil {
-		return hash, err
-	}
-	newHash, ok := KnownHashes[algorithm]
-	if !ok {
-		return hash, fmt.Errorf("Unknown hash algorithm %s", algorithm)
+	if err == nil {
+		return hash, nil
 	}
-	hasher := newHash()
-	_, err = hasher.Write(k.PublicKey().Pack())
+	s, err := k.PublicKey().sexp(false)
 	if err != nil {
-		return hash, err
+		return Hash{}, err
 	}
-	hash.Algorithm = algorithm
-	hash.Hash = hasher.Sum(nil)
-	return hash, nil
+	return HashSexp(algorithm, s)
 }
 
 func (k *PrivateKey) Hashed(algorithm string) ([]byte, error) {
@@ -102,42 +110,52 @@ func (k *PrivateKey) SignatureAlgorithm() string {
 	return "ecdsa-sha2"
 }
 
+// HashAlgorithm returns the hash algorithm natural to k's curve, as
+// PublicKey.HashAlgorithm, or "" if the curve is not supported.
 func (k *PrivateKey) HashAlgorithm() string {
-	return "sha2"
+	c, ok := curveOf(k.Curve)
+	if !ok {
+		return ""
+	}
+	return c.HashAlgorithm
 }
 
+// Equal returns true if k2 is the same key as k, as PublicKey.Equal.
+// Two private keys must also share the same secret scalar.
 func (k *PrivateKey) Equal(k2 Key) bool {
-	if k2 == nil {
+	if k == nil || k2 == nil {
 		return false
 	}
-	for algorithm, _ := range KnownHashes {
-		// we know that HashExp cannot fail because the algorithms will be correct
-		hash1, _ := k.HashExp(algorithm)
-		hash2, _ := k2.HashExp(algorithm)
-		if hash1.Equal(hash2) {
-			return true
-		}
+	if k2, ok := k2.(*PrivateKey); ok {
+		return k2 != nil && k.D != nil && k2.D != nil && k.D.Cmp(k2.D) == 0 && k.PublicKey().Equal(k2)
 	}
-	return false
+	return k.PublicKey().Equal(k2)
 }
 
+// Subject returns the subject of k's public key, i.e. the hash of the
+// public key natural to its curve, or nil if k's curve is unknown.
 func (k *PrivateKey) Subject() (sexp sexprs.Sexp) {
-	var algorithm string
-	switch k.Curve {
-	case elliptic.P256():
-		algorithm = "sha256"
-	case elliptic.P384():
-		algorithm = "sha384"
-	default:
+	curve, ok := curveOf(k.Curve)
+	if !ok {
 		return nil
 	}
-	hash, err := k.HashExp(algorithm)
+	hash, err := k.HashExp(curve.HashAlgorithm)
 	if err != nil {
 		return nil
 	}
 	return hash.Subject()
 }
 
+// Fingerprint returns the hash of k's public key by which its Subject
+// refers to it, as PublicKey.Fingerprint.  A private key has no
+// preferred hash, so this is always the one natural to its curve.
+func (k *PrivateKey) Fingerprint() (Hash, error) {
+	if _, ok := curveOf(k.Curve); !ok {
+		return Hash{}, unsupportedCurve(k.Curve)
+	}
+	return k.HashExp(k.PublicKey().subjectHashAlgorithm())
+}
+
 func (k *PrivateKey) sign(h Hash) (sig *Signature, err error) {
 	r, s, err := ecdsa.Sign(rand.Reader, &k.PrivateKey, h.Hash)
 	if err != nil {
@@ -147,27 +165,77 @@ func (k *PrivateKey) sign(h Hash) (sig *Signature, err error) {
 }
 
 func (k *PrivateKey) Sign(s sexprs.Sexp) (sig *Signature, err error) {
-	hash := Hash{}
-	switch k.Curve {
-	case elliptic.P256():
-		hash.Algorithm = "sha256"
-	case elliptic.P384():
-		hash.Algorithm = "sha384"
-	default:
-		return nil, fmt.Errorf("Only p256 & p384 are currently supported")
-	}
-	hasher := KnownHashes[hash.Algorithm]()
-	_, err = hasher.Write(s.Pack())
+	curve, ok := curveOf(k.Curve)
+	if !ok {
+		return nil, unsupportedCurve(k.Curve)
+	}
+	return k.SignWith(s, curve.HashAlgorithm)
+}
+
+// SignWith returns k's signature of s, hashed under algorithm rather
+// than the algorithm natural to k's curve, e.g. to sign with a p256 key
+// under sha512.  algorithm must be one of KnownHashes; the signature's
+// hash records it, so Signature.Verify needs no further help.
+func (k *PrivateKey) SignWith(s sexprs.Sexp, algorithm string) (sig *Signature, err error) {
+	if _, ok := curveOf(k.Curve); !ok {
+		return nil, unsupportedCurve(k.Curve)
+	}
+	if _, ok := knownHash(algorithm); !ok {
+		return nil, fmt.Errorf("Unknown hash algorithm %s", algorithm)
+	}
+	hash, err := HashSexp(algorithm, s)
 	if err != nil {
 		return nil, err
 	}
-	hash.Hash = hasher.Sum(nil)
 	return k.sign(hash)
 }
 
+// SignDeterministic returns k's signature of s, as Sign, but with its
+// nonce derived from k & s as specified by RFC 6979 rather than drawn
+// at random: the same key & S-expression always yield the same
+// signature.  This is useful for reproducible signed data & for
+// testing.  Keys on the NIST curves and, when built with the secp256k1
+// tag, on secp256k1 are supported; other curves yield an error.
+func (k *PrivateKey) SignDeterministic(s sexprs.Sexp) (sig *Signature, err error) {
+	curve, ok := curveOf(k.Curve)
+	if !ok {
+		return nil, unsupportedCurve(k.Curve)
+	}
+	hash, err := HashSexp(curve.HashAlgorithm, s)
+	if err != nil {
+		return nil, err
+	}
+	return k.signDeterministic(hash)
+}
+
+func (k *PrivateKey) signDeterministic(h Hash) (sig *Signature, err error) {
+	if _, ok := knownHash(h.Algorithm); !ok {
+		return nil, fmt.Errorf("Unknown hash algorithm %s", h.Algorithm)
+	}
+	r, s, err := signRFC6979(&k.PrivateKey, h.Hash, h.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{Hash: h, Principal: k.PublicKey(), R: r, S: s}, nil
+}
+
+// Signer returns k as a crypto.Signer, for use with libraries such as
+// crypto/tls which sign digests directly.  Its Public method returns
+// k's ecdsa.PublicKey and its Sign method returns an ASN.1 DER-encoded
+// ECDSA signature of the digest it is given.  This bypasses the SPKI
+// signature format entirely and is purely for interoperability; use
+// k.Sign to sign S-expressions.
+func (k *PrivateKey) Signer() crypto.Signer {
+	return &k.PrivateKey
+}
+
 // String is a shortcut for k.Sexp().String()
 func (k *PrivateKey) String() (s string) {
-	return k.Sexp().String()
+	sexp := k.Sexp()
+	if sexp == nil {
+		return ""
+	}
+	return sexp.String()
 }
 
 // EvalPrivateKey converts the S-expression s to a PrivateKey, or
@@ -180,8 +248,8 @@ func (k *PrivateKey) String() (s string) {
 // will likely be an interface.
 func EvalPrivateKey(s sexprs.Sexp) (k PrivateKey, err error) {
 	l, ok := s.(sexprs.List)
-	if !ok {
-		return k, fmt.Errorf("Key S-expression must be a list")
+	if !ok || len(l) == 0 {
+		return k, fmt.Errorf("Key S-expression must be a non-empty list")
 	}
 	if !privateKeyAtom.Equal(l[0]) {
 		return k, fmt.Errorf("Key S-expression must start with 'private-key'")
@@ -190,7 +258,6 @@ func EvalPrivateKey(s sexprs.Sexp) (k PrivateKey, err error) {
 		return k, fmt.Errorf("Key S-expression must have two elements")
 	}
 	return evalECDSAPrivateKey(l[1])
-	panic("Can't reach here")
 }
 
 func evalECDSAPrivateKey(s sexprs.Sexp) (k PrivateKey, err error) {
@@ -201,18 +268,10 @@ func evalECDSAPrivateKey(s sexprs.Sexp) (k PrivateKey, err error) {
 	if len(l) != 5 {
 		return k, fmt.Errorf("ECDSA key must have 5 elements")
 	}
-	switch {
-	case ecdsa256Atom.Equal(l[0]):
-		k, err = evalECDSASHA2PrivateKeyTerms(l)
-		if err != nil {
-			return k, err
-		}
-		return k, nil
-	case ecdsa384Atom.Equal(l[0]):
-	default:
+	if !ecdsaSHA2Atom.Equal(l[0]) {
 		return k, fmt.Errorf("ECDSA key S-expression must start with 'ecdsa-sha2'")
 	}
-	panic("Can't reach here")
+	return evalECDSASHA2PrivateKeyTerms(l)
 }
 
 func evalECDSASHA2PrivateKeyTerms(l sexprs.List) (k PrivateKey, err error) {
@@ -220,59 +279,215 @@ func evalECDSASHA2PrivateKeyTerms(l sexprs.List) (k PrivateKey, err error) {
 	if err != nil {
 		return k, err
 	}
-	switch curve {
-	case "p256":
-		k.Curve = elliptic.P256()
-	case "p384":
-		k.Curve = elliptic.P384()
-	default:
-		return k, fmt.Errorf("Curve must be either 'p256' or 'p384'")
+	c, ok := curveByName(curve)
+	if !ok {
+		return k, UnsupportedCurveError{curve}
 	}
+	k.Curve = c.Curve
 	k.X, err = evalNamedBigInt("x", l[2])
 	if err != nil {
-		return k, err
+		return PrivateKey{}, err
 	}
 	k.Y, err = evalNamedBigInt("y", l[3])
 	if err != nil {
-		return k, err
+		return PrivateKey{}, err
 	}
 	k.D, err = evalNamedBigInt("d", l[4])
 	if err != nil {
-		return k, err
+		return PrivateKey{}, err
 	}
 	return k, nil
 }
 
-// BUG(eadmund): parse algorithm as a canonical s-expression
-
 // GeneratePrivateKey generates a new private key as specified by
-// algorithm, e.g. "(ecdsa-sha2 (curve p256))".  Returns an error if the
+// algorithm, an S-expression in either canonical or advanced form,
+// e.g. "(ecdsa-sha2 (curve p256))".  Returns an error if the
 // algorithm is unknown.
 func GeneratePrivateKey(algorithm string) (k *PrivateKey, err error) {
-	switch algorithm {
-	case "(ecdsa-sha2 (curve p256))":
-		return GenerateP256Key()
-	default:
+	s, rest, err := sexprs.Parse([]byte(algorithm))
+	if err != nil {
+		return nil, fmt.Errorf("Unknown algorithm '%s': %s", algorithm, err)
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, fmt.Errorf("Unknown algorithm '%s': trailing data", algorithm)
+	}
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) != 2 || !ecdsaSHA2Atom.Equal(l[0]) {
 		return nil, fmt.Errorf("Unknown algorithm '%s'", algorithm)
 	}
+	curve, err := evalCurve(l[1])
+	if err != nil {
+		return nil, err
+	}
+	c, _ := curveByName(curve)
+	return generateKey(c.Curve)
 }
 
 func GenerateP256Key() (k *PrivateKey, err error) {
-	kk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return generateKey(elliptic.P256())
+}
+
+func generateKey(curve elliptic.Curve) (k *PrivateKey, err error) {
+	kk, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
-	// BUG(eadmund): zeroise kk afterwards
 	k = &PrivateKey{HashKey{}, *kk}
+	// k must not share kk's secret, which is about to be wiped
+	k.D = new(big.Int).Set(kk.D)
+	zeroizeInt(kk.D)
 	return k, nil
 }
 
-func (k *PrivateKey) IssueAuthCert(publicKey *PublicKey, tag sexprs.Sexp, validity Valid) (c AuthCert) {
+// Zeroize wipes k's secret scalar, so that it does not linger in memory
+// once k is no longer needed, and clears its public point.  The secret
+// is overwritten in place; the public coordinates, which may be shared
+// with public keys derived from k, are merely replaced with zero.  k
+// cannot be used after being zeroised.
+func (k *PrivateKey) Zeroize() {
+	if k.D != nil {
+		zeroizeInt(k.D)
+	}
+	k.X = new(big.Int)
+	k.Y = new(big.Int)
+}
+
+// zeroizeInt overwrites the words backing n with zeroes before setting
+// n to zero; merely calling n.SetInt64(0) would leave its old value in
+// the underlying buffer.
+func zeroizeInt(n *big.Int) {
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
+
+// MinSeedSize is the minimum length of a seed accepted by
+// GenerateP256KeyFromSeed.
+const MinSeedSize = 32
+
+// GenerateP256KeyFromSeed deterministically derives a P256 private key
+// from seed, which must be at least MinSeedSize bytes long: the same
+// seed always yields the same key.  This is intended for tests &
+// reproducible infrastructure.  The key is exactly as secret as the
+// seed, which must therefore be uniformly random, kept as carefully as
+// the key itself and never used for anything else; anyone who learns
+// it can regenerate the key.
+func GenerateP256KeyFromSeed(seed []byte) (k *PrivateKey, err error) {
+	if len(seed) < MinSeedSize {
+		return nil, fmt.Errorf("Seed must be at least %d bytes long", MinSeedSize)
+	}
+	curve := elliptic.P256()
+	// Expand the seed into 64 more bits than the order of the
+	// curve so that reducing it modulo the order introduces only a
+	// negligible bias (cf. FIPS 186-4 B.4.1).
+	params := curve.Params()
+	b, err := hkdf.Key(sha256.New, seed, nil, "spki p256 key", (params.N.BitLen()+64)/8)
+	if err != nil {
+		return nil, err
+	}
+	d := new(big.Int).SetBytes(b)
+	n := new(big.Int).Sub(params.N, big.NewInt(1))
+	d.Mod(d, n)
+	d.Add(d, big.NewInt(1))
+	return privateKeyFromScalar(curve, d), nil
+}
+
+// PrivateKeyFromScalar returns the private key on the named curve,
+// e.g. "p256", whose secret scalar is the big-endian integer d,
+// deriving its public point.  It returns an error if the curve is
+// unknown or d is out of range for it.  It is chiefly useful for
+// building keys from known test vectors.
+func PrivateKeyFromScalar(curve string, d []byte) (k *PrivateKey, err error) {
+	c, ok := curveByName(curve)
+	if !ok {
+		return nil, UnsupportedCurveError{curve}
+	}
+	n := new(big.Int).SetBytes(d)
+	if n.Sign() <= 0 || n.Cmp(c.Curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("Scalar out of range for curve %s", curve)
+	}
+	return privateKeyFromScalar(c.Curve, n), nil
+}
+
+// PrivateKeyFromECDSA returns sk as a PrivateKey.  The key is copied,
+// so zeroising the result does not affect sk.  It returns an error if
+// sk's curve is not a known one or its scalar is out of range.
+func PrivateKeyFromECDSA(sk *ecdsa.PrivateKey) (k *PrivateKey, err error) {
+	if sk == nil || sk.D == nil {
+		return nil, fmt.Errorf("Private key must not be nil")
+	}
+	c, ok := curveOf(sk.Curve)
+	if !ok {
+		return nil, unsupportedCurve(sk.Curve)
+	}
+	if sk.D.Sign() <= 0 || sk.D.Cmp(c.Curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("Scalar out of range for curve %s", c.Name)
+	}
+	return privateKeyFromScalar(c.Curve, new(big.Int).Set(sk.D)), nil
+}
+
+// PrivateKeyFromPKCS8 parses der, a DER-encoded PKCS #8 private key
+// such as standard tools produce, as an ECDSA PrivateKey.  It returns
+// an error if der holds any other kind of key, e.g. an RSA or Ed25519
+// one, or one on an unsupported curve.
+func PrivateKeyFromPKCS8(der []byte) (k *PrivateKey, err error) {
+	sk, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := sk.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type %T", sk)
+	}
+	return PrivateKeyFromECDSA(ecdsaKey)
+}
+
+// MarshalPKCS8 returns k as a DER-encoded PKCS #8 private key.  It
+// returns an UnsupportedCurveError if k's curve is not supported, and
+// an error if PKCS #8 cannot represent it, e.g. for secp256k1.
+func (k *PrivateKey) MarshalPKCS8() ([]byte, error) {
+	if _, ok := curveOf(k.Curve); !ok {
+		return nil, unsupportedCurve(k.Curve)
+	}
+	return x509.MarshalPKCS8PrivateKey(&k.PrivateKey)
+}
+
+// privateKeyFromScalar returns the private key on curve whose secret
+// scalar is d, deriving its public point.
+func privateKeyFromScalar(curve elliptic.Curve, d *big.Int) *PrivateKey {
+	k := new(PrivateKey)
+	k.Curve = curve
+	k.D = d
+	k.X, k.Y = curve.ScalarBaseMult(d.Bytes())
+	return k
+}
+
+// IssueAuthCert returns a delegating certificate issued by k, granting
+// tag to subject for the period validity.  The subject may be a public
+// key, or just a hash (a Hash or HashKey) when the issuer does not
+// have the key itself.  A public key subject is written as its hash;
+// pass k2.AsSubject(true) to write the full key k2 instead.
+func (k *PrivateKey) IssueAuthCert(subject Subject, tag sexprs.Sexp, validity Valid) (c AuthCert) {
 	c.Issuer = Name{Principal: k.PublicKey()}
-	c.Subject = publicKey
+	c.Subject = subject
 	c.Delegate = true
 	c.Valid = &Valid{}
 	*c.Valid = validity
 	c.Tag = tag
 	return
 }
+
+// IssueAuthCertWithin is like IssueAuthCert, but for an issuer whose
+// own authority is valid only for issuerValidity: the certificate's
+// validity is the intersection of validity & issuerValidity, so that it
+// cannot outlive the authority it delegates.  It returns an error if
+// the two do not overlap.
+func (k *PrivateKey) IssueAuthCertWithin(subject Subject, tag sexprs.Sexp, validity, issuerValidity Valid) (c AuthCert, err error) {
+	nonEmpty, v := validity.Intersect(issuerValidity)
+	if !nonEmpty {
+		return AuthCert{}, fmt.Errorf("Validity %s lies outside of the issuer's validity %s", validity, issuerValidity)
+	}
+	return k.IssueAuthCert(subject, tag, v), nil
+}
@@ -7,14 +7,22 @@ package spki
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/x509"
 	"fmt"
 	"github.com/eadmund/sexprs"
+	"math/big"
+	"strings"
 )
 
 type PublicKey struct {
 	HashKey
 	Pk ecdsa.PublicKey
+	// PreferredHash, if set, is the hash algorithm with which the
+	// key would like to be referred to, e.g. in a certificate
+	// subject.  If it is empty then the curve's own hash
+	// algorithm is used.  It is written out with the key but is
+	// not part of it: the key's hashes are the same without it.
+	PreferredHash string
 }
 
 // EvalPublicKey converts the S-expression s to a PublicKey, or returns
@@ -22,13 +30,16 @@ type PublicKey struct {
 //    (public-key (ecdsa-sha2 (curve p256) (x |...|) (y |...|)))
 // The format of a 384-bit ECDSA public key is:
 //    (public-key (ecdsa-sha2 (curve p384) (x |...|) (y |...|)))
+// Either may be followed by a hint of the hash algorithm the key
+// prefers to be referenced by, e.g.:
+//    (public-key (ecdsa-sha2 (curve p256) (x |...|) (y |...|) (hash-algorithm sha512)))
 // Neither RSA, DSA, NIST curves other than p256 & p384 nor non-NIST-curve 
 // ECDSA keys are supported at this point in time.  In the future PublicKey
 // will likely be an interface.
 func EvalPublicKey(s sexprs.Sexp) (k *PublicKey, err error) {
 	l, ok := s.(sexprs.List)
-	if !ok {
-		return nil, fmt.Errorf("Key S-expression must be a list")
+	if !ok || len(l) == 0 {
+		return nil, fmt.Errorf("Key S-expression must be a non-empty list")
 	}
 	if !publicKeyAtom.Equal(l[0]) {
 		return nil, fmt.Errorf("Key S-expression must start with 'public-key'")
@@ -44,38 +55,28 @@ func evalECDSAPublicKey(s sexprs.Sexp) (k *PublicKey, err error) {
 	if !ok {
 		return nil, fmt.Errorf("ECDSA key S-expression must be a list")
 	}
-	if len(l) != 4 {
-		return nil, fmt.Errorf("ECDSA key must have 4 elements")
+	if len(l) != 4 && len(l) != 5 {
+		return nil, fmt.Errorf("ECDSA key must have 4 or 5 elements")
 	}
-	switch {
-	case ecdsa256Atom.Equal(l[0]):
-		k, err = evalECDSA256PublicKeyTerms(l)
-		if err != nil {
-			return nil, err
-		}
-		return k, nil
-	case ecdsa384Atom.Equal(l[0]):
-		panic("p384 not yet supported")
-	default:
+	if !ecdsaSHA2Atom.Equal(l[0]) {
 		return nil, fmt.Errorf("ECDSA key S-expression must start with 'ecdsa-sha2'")
 	}
-	panic("Can't reach here")
+	return evalECDSAPublicKeyTerms(l)
 }
 
-func evalECDSA256PublicKeyTerms(l sexprs.List) (k *PublicKey, err error) {
+// evalECDSAPublicKeyTerms evaluates the terms of an ECDSA public key on
+// any known curve, which its (curve ...) term identifies.
+func evalECDSAPublicKeyTerms(l sexprs.List) (k *PublicKey, err error) {
 	k = new(PublicKey)
 	curve, err := evalCurve(l[1])
 	if err != nil {
 		return nil, err
 	}
-	switch curve {
-	case "p256":
-		k.Pk.Curve = elliptic.P256()
-	case "p384":
-		k.Pk.Curve = elliptic.P384()
-	default:
-		return nil, fmt.Errorf("Curve must be either 'p256' or 'p384'")
+	c, ok := curveByName(curve)
+	if !ok {
+		return nil, UnsupportedCurveError{curve}
 	}
+	k.Pk.Curve = c.Curve
 	k.Pk.X, err = evalNamedBigInt("x", l[2])
 	if err != nil {
 		return nil, err
@@ -84,61 +85,166 @@ func evalECDSA256PublicKeyTerms(l sexprs.List) (k *PublicKey, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(l) == 5 {
+		k.PreferredHash, err = evalHashAlgorithmHint(l[4])
+		if err != nil {
+			return nil, err
+		}
+	}
 	return k, nil
 }
 
+func evalHashAlgorithmHint(s sexprs.Sexp) (algorithm string, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) != 2 || !hashAlgorithmAtom.Equal(l[0]) {
+		return "", fmt.Errorf("Hash algorithm hint must be of the form (hash-algorithm ALGORITHM)")
+	}
+	a, ok := l[1].(sexprs.Atom)
+	if !ok || !validHash(a.Value) {
+		return "", fmt.Errorf("Unknown hash algorithm in hint")
+	}
+	return string(a.Value), nil
+}
+
 func evalCurve(l sexprs.Sexp) (curve string, err error) {
 	ll, ok := l.(sexprs.List)
-	if !ok {
-		return curve, fmt.Errorf("Curve must be a list")
+	if !ok || len(ll) != 2 {
+		return curve, fmt.Errorf("Curve must be a list (curve NAME)")
 	}
 	if c, ok := ll[0].(sexprs.Atom); !ok || !bytes.Equal(c.Value, []byte("curve")) {
 		return curve, fmt.Errorf("Curve must start with 'curve'")
 	}
-	if c, ok := ll[1].(sexprs.Atom); !ok {
-		return curve, fmt.Errorf("Curve must be either p256 or p512")
-	} else {
-		curve = string(c.Value)
-		if curve != "p256" && curve != "p512" {
-			return curve, fmt.Errorf("Curve must be either p256 or p512")
-		}
-		return curve, nil
+	c, ok := ll[1].(sexprs.Atom)
+	if !ok {
+		return curve, fmt.Errorf("Curve must be one of %s", strings.Join(curveNames(), ", "))
+	}
+	curve = string(c.Value)
+	if _, ok := curveByName(curve); !ok {
+		return curve, UnsupportedCurveError{curve}
+	}
+	return curve, nil
+}
+
+// PublicKeyFromCoords returns the public key on the named curve,
+// e.g. "p256", whose point has the big-endian coordinates x & y.  It
+// returns an error if the curve is unknown or the point is not on it.
+func PublicKeyFromCoords(curve string, x, y []byte) (k *PublicKey, err error) {
+	c, ok := curveByName(curve)
+	if !ok {
+		return nil, UnsupportedCurveError{curve}
+	}
+	k = new(PublicKey)
+	k.Pk.Curve = c.Curve
+	k.Pk.X = new(big.Int).SetBytes(x)
+	k.Pk.Y = new(big.Int).SetBytes(y)
+	if !c.Curve.IsOnCurve(k.Pk.X, k.Pk.Y) {
+		return nil, fmt.Errorf("Point is not on curve %s", curve)
 	}
-	panic("Can't get here")
+	return k, nil
 }
 
+// PublicKeyFromECDSA returns pk as a PublicKey, e.g. to use a key taken
+// from an X.509 certificate as an SPKI principal.  It returns an error
+// if pk's curve is not a known one or its point is not on the curve.
+func PublicKeyFromECDSA(pk *ecdsa.PublicKey) (k *PublicKey, err error) {
+	if pk == nil {
+		return nil, fmt.Errorf("Public key must not be nil")
+	}
+	c, ok := curveOf(pk.Curve)
+	if !ok {
+		return nil, unsupportedCurve(pk.Curve)
+	}
+	if pk.X == nil || pk.Y == nil || !c.Curve.IsOnCurve(pk.X, pk.Y) {
+		return nil, fmt.Errorf("Point is not on curve %s", c.Name)
+	}
+	k = new(PublicKey)
+	k.Pk.Curve = c.Curve
+	k.Pk.X = new(big.Int).Set(pk.X)
+	k.Pk.Y = new(big.Int).Set(pk.Y)
+	return k, nil
+}
+
+// ECDSA returns k as a standard library ECDSA public key.  It is k's
+// own key, not a copy.
+func (k *PublicKey) ECDSA() *ecdsa.PublicKey {
+	return &k.Pk
+}
+
+// PublicKeyFromPKIX parses der, a DER-encoded X.509
+// SubjectPublicKeyInfo such as that found in a certificate, as an ECDSA
+// PublicKey.  It returns an error if der holds any other kind of key,
+// e.g. an RSA or Ed25519 one, or one on an unsupported curve.
+func PublicKeyFromPKIX(der []byte) (k *PublicKey, err error) {
+	pk, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported public key type %T", pk)
+	}
+	return PublicKeyFromECDSA(ecdsaKey)
+}
+
+// MarshalPKIX returns k as a DER-encoded X.509 SubjectPublicKeyInfo.
+func (k *PublicKey) MarshalPKIX() ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(&k.Pk)
+}
+
+// Sexp returns k as an S-expression, or nil if k's curve is not
+// supported; SexpErr reports why.
 func (k *PublicKey) Sexp() (s sexprs.Sexp) {
+	s, _ = k.SexpErr()
+	return s
+}
+
+// SexpErr returns k as an S-expression, or an UnsupportedCurveError if
+// k's curve is not supported.
+func (k *PublicKey) SexpErr() (s sexprs.Sexp, err error) {
+	return k.sexp(true)
+}
+
+// sexp returns k as an S-expression, including its preferred hash if
+// hint is true.  The hint is not part of k's identity: k's hashes are
+// taken of the S-expression without it, so that a key hashes the same
+// whether or not it expresses a preference.
+func (k *PublicKey) sexp(hint bool) (s sexprs.Sexp, err error) {
 	var curve sexprs.Atom
-	switch k.Pk.Curve {
-	case elliptic.P256():
-		curve.Value = []byte("p256")
-	case elliptic.P384():
-		curve.Value = []byte("p384")
-	default:
-		panic(fmt.Sprintf("Bad curve value %v", k.Pk.Curve))
+	c, ok := curveOf(k.Pk.Curve)
+	if !ok {
+		return nil, unsupportedCurve(k.Pk.Curve)
 	}
-	return sexprs.List{
-		sexprs.Atom{Value: []byte("public-key")},
+	curve.Value = []byte(c.Name)
+	key := sexprs.List{
+		sexprs.Atom{Value: []byte("ecdsa-sha2")},
+		sexprs.List{
+			sexprs.Atom{Value: []byte("curve")},
+			curve,
+		},
 		sexprs.List{
-			sexprs.Atom{Value: []byte("ecdsa-sha2")},
-			sexprs.List{
-				sexprs.Atom{Value: []byte("curve")},
-				curve,
-			},
-			sexprs.List{
-				sexprs.Atom{Value: []byte("x")},
-				sexprs.Atom{Value: k.Pk.X.Bytes()},
-			},
-			sexprs.List{
-				sexprs.Atom{Value: []byte("y")},
-				sexprs.Atom{Value: k.Pk.Y.Bytes()},
-			},
+			sexprs.Atom{Value: []byte("x")},
+			sexprs.Atom{Value: k.Pk.X.Bytes()},
+		},
+		sexprs.List{
+			sexprs.Atom{Value: []byte("y")},
+			sexprs.Atom{Value: k.Pk.Y.Bytes()},
 		},
 	}
+	if hint && k.PreferredHash != "" {
+		key = append(key, sexprs.List{hashAlgorithmAtom, sexprs.Atom{Value: []byte(k.PreferredHash)}})
+	}
+	return sexprs.List{
+		sexprs.Atom{Value: []byte("public-key")},
+		key,
+	}, nil
 }
 
 func (k *PublicKey) Pack() ([]byte) {
-	return k.Sexp().Pack()
+	s := k.Sexp()
+	if s == nil {
+		return nil
+	}
+	return s.Pack()
 }
 
 // Key methods
@@ -155,21 +261,14 @@ func (k *PublicKey) PublicKey() *PublicKey {
 
 func (k *PublicKey) HashExp(algorithm string) (hash Hash, err error) {
 	hash, err = k.HashKey.HashExp(algorithm)
-	if err != nil {
+	if err == nil {
 		return hash, nil
 	}
-	newHash, ok := KnownHashes[algorithm]
-	if !ok {
-		return hash, fmt.Errorf("Unknown hash algorithm %s", algorithm)
-	}
-	hasher := newHash()
-	_, err = hasher.Write(k.Pack())
+	s, err := k.sexp(false)
 	if err != nil {
-		return hash, err
+		return Hash{}, err
 	}
-	hash.Algorithm = algorithm
-	hash.Hash = hasher.Sum(nil)
-	return hash, nil
+	return HashSexp(algorithm, s)
 }
 
 func (k *PublicKey) Hashed(algorithm string) ([]byte, error) {
@@ -181,43 +280,68 @@ func (k *PublicKey) SignatureAlgorithm() string {
 	return "ecdsa-sha2"
 }
 
+// HashAlgorithm returns the hash algorithm with which k's signatures
+// are made, e.g. "sha256" for a p256 key or "sha384" for a p384 one, or
+// "" if k's curve is not supported.  It names a hash, not the curve.
 func (k *PublicKey) HashAlgorithm() string {
-	switch k.Pk.Curve {
-	case elliptic.P256():
-		return "p256"
-	case elliptic.P384():
-		return "p384"
-	default:
+	c, ok := curveOf(k.Pk.Curve)
+	if !ok {
 		return ""
 	}
+	return c.HashAlgorithm
 }
 
 func (k *PublicKey) String() string {
-	return k.Sexp().String()
+	s := k.Sexp()
+	if s == nil {
+		return ""
+	}
+	return s.String()
 }
 
+// Equal returns true if k2 is the same key as k: the same public key,
+// the private key whose public key k is or a hash of k.  Keys with
+// public components are compared directly; only hashes are compared
+// by hashing k.
 func (k *PublicKey) Equal(k2 Key) bool {
-	if k == nil {
+	if k == nil || k2 == nil {
 		return false
 	}
-	for _, h := range k.Hashes {
-		h2, err := k2.HashExp(h.Algorithm)
-		if err != nil {
-			continue
-		}
-		if h.Equal(h2) {
-			return true
-		}
+	if k2.IsHash() {
+		return k2.Equal(k)
 	}
-	return k.Sexp().Equal(k2.Sexp())
+	pk2 := k2.PublicKey()
+	return pk2 != nil && k.Pk.Equal(&pk2.Pk)
 }
 
-// Subject always returns the 'natural' hash of k, i.e. a hash with an
+// subjectHashAlgorithm returns the hash algorithm with which k should
+// be referred to: its preferred one if it has one, or else the
+// algorithm natural to its curve.
+func (k *PublicKey) subjectHashAlgorithm() string {
+	if k.PreferredHash != "" {
+		return k.PreferredHash
+	}
+	return k.HashAlgorithm()
+}
+
+// Subject returns the hash of k under its preferred hash algorithm,
+// or if it has none its 'natural' hash, i.e. a hash with an
 // appropriate length.
 func (k *PublicKey) Subject() sexprs.Sexp {
-	hash, err := k.HashExp(k.HashAlgorithm())
+	hash, err := k.HashExp(k.subjectHashAlgorithm())
 	if err != nil {
 		return nil
 	}
-	return sexprs.List{sexprs.Atom{Value: []byte("subject")}, hash.Sexp()}
+	return hash.Sexp()
+}
+
+// Fingerprint returns the hash by which k's Subject refers to it: under
+// its preferred hash algorithm if it has one, or else under the one
+// natural to its curve, e.g. sha256 for p256 & sha384 for p384.  It
+// returns an error if k's curve is unknown.
+func (k *PublicKey) Fingerprint() (Hash, error) {
+	if _, ok := curveOf(k.Pk.Curve); !ok {
+		return Hash{}, unsupportedCurve(k.Pk.Curve)
+	}
+	return k.HashExp(k.subjectHashAlgorithm())
 }
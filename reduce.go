@@ -0,0 +1,102 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"fmt"
+)
+
+// Reduce performs SPKI 5-tuple reduction on the chain of certificates
+// certs, returning the single authorisation they together confer from
+// the issuer of the first to the subject of the last.  Each
+// certificate's subject must be the key which issued the next, and
+// every certificate but the last must permit delegation, to a depth
+// which the chain does not exceed.  The result's tag & validity are
+// the intersections of those of the whole chain, and it may be
+// delegated only if the last certificate may be and the depths of
+// those before it are not exhausted.  An
+// error is returned if the chain is broken, if delegation is violated
+// or if the tags or validity periods do not overlap.
+//
+// Names are not resolved: every issuer must be a principal, and every
+// subject a key or the hash of one.  In particular Reduce does not
+// know who Self is, and returns an error for a certificate issued by
+// Self; resolve its issuer with Name.ResolveSelf first, as Authorize
+// does.  The result carries the online tests of the whole chain; if
+// any is one-time, the result's Cacheable method returns false.
+func Reduce(certs []*AuthCert) (*AuthCert, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("Cannot reduce an empty chain")
+	}
+	for i, cert := range certs {
+		if cert == nil {
+			return nil, fmt.Errorf("Certificate %d is nil", i)
+		}
+		if cert.Issuer.IsSelf() {
+			return nil, fmt.Errorf("Issuer of certificate %d is Self, which must be resolved first", i)
+		}
+		if !cert.Issuer.IsPrincipal() {
+			return nil, fmt.Errorf("Issuer of certificate %d is not a principal", i)
+		}
+	}
+	result := &AuthCert{
+		Issuer:  certs[0].Issuer,
+		Subject: certs[0].Subject,
+		Tag:     certs[0].Tag,
+	}
+	depth := certs[0].delegationDepth()
+	if certs[0].Valid != nil {
+		v := *certs[0].Valid
+		result.Valid = &v
+	}
+	for i, cert := range certs[1:] {
+		if depth == 0 {
+			return nil, fmt.Errorf("Certificate %d may not be delegated", i)
+		}
+		if !result.subjectIs(cert.Issuer.Principal) {
+			return nil, fmt.Errorf("Subject of certificate %d is not the issuer of certificate %d", i, i+1)
+		}
+		tag, err := IntersectTags(result.Tag, cert.Tag)
+		if err != nil {
+			return nil, err
+		}
+		if tag == nil {
+			return nil, fmt.Errorf("Tag of certificate %d does not overlap those before it", i+1)
+		}
+		if cert.Valid != nil {
+			v := *cert.Valid
+			if result.Valid != nil {
+				var ok bool
+				ok, v = result.Valid.Intersect(v)
+				if !ok {
+					return nil, fmt.Errorf("Validity of certificate %d does not overlap those before it", i+1)
+				}
+			}
+			result.Valid = &v
+		}
+		result.Subject = cert.Subject
+		result.Tag = tag
+		// each certificate uses up one of the delegations permitted
+		// by those before it, and may permit fewer
+		if depth > 0 {
+			depth--
+		}
+		if d := cert.delegationDepth(); depth < 0 || (d >= 0 && d < depth) {
+			depth = d
+		}
+	}
+	result.setDelegationDepth(depth)
+	return result, nil
+}
+
+// subjectIs returns true if a's subject is the key k, or the hash of
+// it.
+func (a *AuthCert) subjectIs(k Key) bool {
+	sk, ok := a.SubjectKey()
+	if !ok || k == nil {
+		return false
+	}
+	return sk.Equal(k)
+}
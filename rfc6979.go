@@ -0,0 +1,73 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// cryptoHashes maps the names of the built-in hash algorithms to the
+// standard library's identifiers for them.
+var cryptoHashes = map[string]crypto.Hash{
+	"sha1":     crypto.SHA1,
+	"sha224":   crypto.SHA224,
+	"sha256":   crypto.SHA256,
+	"sha384":   crypto.SHA384,
+	"sha512":   crypto.SHA512,
+	"sha3-256": crypto.SHA3_256,
+	"sha3-384": crypto.SHA3_384,
+	"sha3-512": crypto.SHA3_512,
+}
+
+// A deterministicSigner returns the signature (r, s) of digest by
+// priv, whose nonce is derived from priv & digest as specified by
+// RFC 6979, in constant time.
+type deterministicSigner func(priv *ecdsa.PrivateKey, digest []byte) (r, s *big.Int, err error)
+
+// deterministicSigners holds the signers for curves, such as
+// secp256k1, which the standard library cannot sign deterministically.
+// It is guarded by curvesMu.
+var deterministicSigners = make(map[elliptic.Curve]deterministicSigner)
+
+// registerDeterministicSigner makes sign the means of signing
+// deterministically with keys on curve.
+func registerDeterministicSigner(curve elliptic.Curve, sign deterministicSigner) {
+	curvesMu.Lock()
+	defer curvesMu.Unlock()
+	deterministicSigners[curve] = sign
+}
+
+// signRFC6979 returns the ECDSA signature (r, s) of digest, a digest
+// under the hash algorithm named algorithm, by priv.  Its nonce is
+// derived from priv & digest as specified by RFC 6979, so the same key
+// & digest always yield the same signature.  Keys on the NIST curves
+// are signed by the standard library, using HMAC with algorithm;
+// others need a registered deterministicSigner.
+func signRFC6979(priv *ecdsa.PrivateKey, digest []byte, algorithm string) (r, s *big.Int, err error) {
+	curvesMu.RLock()
+	sign, ok := deterministicSigners[priv.Curve]
+	curvesMu.RUnlock()
+	if ok {
+		return sign(priv, digest)
+	}
+	h, ok := cryptoHashes[algorithm]
+	if !ok || !h.Available() {
+		return nil, nil, fmt.Errorf("Cannot sign deterministically with hash algorithm %s", algorithm)
+	}
+	der, err := priv.Sign(nil, digest, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sig struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) != 0 {
+		return nil, nil, fmt.Errorf("Malformed ECDSA signature")
+	}
+	return sig.R, sig.S, nil
+}
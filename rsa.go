@@ -0,0 +1,417 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/eadmund/sexprs"
+	"math/big"
+)
+
+var (
+	rsaAtom = sexprs.Atom{Value: []byte("rsa-pkcs1-sha256")}
+)
+
+// An RSAPublicKey is an RSA public key, used with PKCS #1 v1.5
+// signatures of SHA-256 digests.  Its S-expression form is:
+//    (public-key (rsa-pkcs1-sha256 (e |...|) (n |...|)))
+type RSAPublicKey struct {
+	HashKey
+	Pk rsa.PublicKey
+}
+
+// An RSAPrivateKey is an RSA private key.  Its S-expression form is:
+//    (private-key (rsa-pkcs1-sha256 (e |...|) (n |...|) (d |...|) (p |...|) (q |...|)))
+type RSAPrivateKey struct {
+	HashKey
+	rsa.PrivateKey
+}
+
+// An RSASignature is a PKCS #1 v1.5 signature by an RSA key.  It
+// looks like:
+//    (signature (hash sha256 |...|) PRINCIPAL (rsa-pkcs1-sha256 |...|))
+type RSASignature struct {
+	Hash      Hash
+	Principal *RSAPublicKey
+	Value     []byte
+}
+
+// GenerateRSAKey returns a new RSA private key with a modulus of bits
+// bits.  Keys of fewer than 2048 bits should not be used.
+func GenerateRSAKey(bits int) (k *RSAPrivateKey, err error) {
+	kk, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	return &RSAPrivateKey{PrivateKey: *kk}, nil
+}
+
+// EvalRSAPublicKey converts the S-expression s to an RSAPublicKey, or
+// returns an error.
+func EvalRSAPublicKey(s sexprs.Sexp) (k *RSAPublicKey, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) != 2 || !publicKeyAtom.Equal(l[0]) {
+		return nil, fmt.Errorf("RSA key S-expression must be of the form (public-key (rsa-pkcs1-sha256 (e |...|) (n |...|)))")
+	}
+	terms, ok := l[1].(sexprs.List)
+	if !ok || len(terms) != 3 || !rsaAtom.Equal(terms[0]) {
+		return nil, fmt.Errorf("RSA key S-expression must be of the form (public-key (rsa-pkcs1-sha256 (e |...|) (n |...|)))")
+	}
+	k = new(RSAPublicKey)
+	k.Pk.E, err = evalRSAExponent(terms[1])
+	if err != nil {
+		return nil, err
+	}
+	k.Pk.N, err = evalNamedBigInt("n", terms[2])
+	if err != nil {
+		return nil, err
+	}
+	if k.Pk.N.Sign() <= 0 {
+		return nil, fmt.Errorf("RSA modulus must be positive")
+	}
+	return k, nil
+}
+
+// EvalRSAPrivateKey converts the S-expression s to an RSAPrivateKey,
+// or returns an error if it is malformed or not a valid key.
+func EvalRSAPrivateKey(s sexprs.Sexp) (k *RSAPrivateKey, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) != 2 || !privateKeyAtom.Equal(l[0]) {
+		return nil, fmt.Errorf("RSA key S-expression must be of the form (private-key (rsa-pkcs1-sha256 (e |...|) (n |...|) (d |...|) (p |...|) (q |...|)))")
+	}
+	terms, ok := l[1].(sexprs.List)
+	if !ok || len(terms) != 6 || !rsaAtom.Equal(terms[0]) {
+		return nil, fmt.Errorf("RSA key S-expression must be of the form (private-key (rsa-pkcs1-sha256 (e |...|) (n |...|) (d |...|) (p |...|) (q |...|)))")
+	}
+	k = new(RSAPrivateKey)
+	k.E, err = evalRSAExponent(terms[1])
+	if err != nil {
+		return nil, err
+	}
+	k.N, err = evalNamedBigInt("n", terms[2])
+	if err != nil {
+		return nil, err
+	}
+	k.D, err = evalNamedBigInt("d", terms[3])
+	if err != nil {
+		return nil, err
+	}
+	p, err := evalNamedBigInt("p", terms[4])
+	if err != nil {
+		return nil, err
+	}
+	q, err := evalNamedBigInt("q", terms[5])
+	if err != nil {
+		return nil, err
+	}
+	k.Primes = []*big.Int{p, q}
+	if err = k.Validate(); err != nil {
+		return nil, err
+	}
+	k.Precompute()
+	return k, nil
+}
+
+func evalRSAExponent(s sexprs.Sexp) (e int, err error) {
+	n, err := evalNamedBigInt("e", s)
+	if err != nil {
+		return 0, err
+	}
+	if !n.IsInt64() || n.Int64() < 3 || n.Int64() > 1<<31-1 {
+		return 0, fmt.Errorf("RSA exponent out of range")
+	}
+	return int(n.Int64()), nil
+}
+
+// Sexp returns k as an S-expression.
+func (k *RSAPublicKey) Sexp() sexprs.Sexp {
+	return sexprs.List{
+		publicKeyAtom,
+		sexprs.List{
+			rsaAtom,
+			sexprs.List{sexprs.Atom{Value: []byte("e")}, sexprs.Atom{Value: big.NewInt(int64(k.Pk.E)).Bytes()}},
+			sexprs.List{sexprs.Atom{Value: []byte("n")}, sexprs.Atom{Value: k.Pk.N.Bytes()}},
+		},
+	}
+}
+
+// Pack returns k's canonical S-expression form.
+func (k *RSAPublicKey) Pack() []byte {
+	return k.Sexp().Pack()
+}
+
+func (k *RSAPublicKey) String() string {
+	return k.Sexp().String()
+}
+
+// IsHash always returns false for an RSA public key.
+func (k *RSAPublicKey) IsHash() bool {
+	return false
+}
+
+// PublicKey always returns nil, as an RSA key has no ECDSA public key;
+// k is itself the public key.  IsHash distinguishes it from a hash.
+func (k *RSAPublicKey) PublicKey() *PublicKey {
+	return nil
+}
+
+func (k *RSAPublicKey) HashExp(algorithm string) (hash Hash, err error) {
+	hash, err = k.HashKey.HashExp(algorithm)
+	if err == nil {
+		return hash, nil
+	}
+	return HashSexp(algorithm, k.Sexp())
+}
+
+func (k *RSAPublicKey) Hashed(algorithm string) ([]byte, error) {
+	hash, err := k.HashExp(algorithm)
+	return hash.Hash, err
+}
+
+func (k *RSAPublicKey) SignatureAlgorithm() string {
+	return "rsa-pkcs1-sha256"
+}
+
+func (k *RSAPublicKey) HashAlgorithm() string {
+	return "sha256"
+}
+
+// Equal returns true if k2 is the same RSA key as k, either public or
+// private, or a hash of k.
+func (k *RSAPublicKey) Equal(k2 Key) bool {
+	if k == nil || k2 == nil {
+		return false
+	}
+	if k2.IsHash() {
+		return k2.Equal(k)
+	}
+	var pk2 *rsa.PublicKey
+	switch k2 := k2.(type) {
+	case *RSAPublicKey:
+		if k2 == nil {
+			return false
+		}
+		pk2 = &k2.Pk
+	case *RSAPrivateKey:
+		if k2 == nil {
+			return false
+		}
+		pk2 = &k2.PrivateKey.PublicKey
+	default:
+		return false
+	}
+	return k.Pk.Equal(pk2)
+}
+
+// Subject returns the sha256 hash of k.
+func (k *RSAPublicKey) Subject() sexprs.Sexp {
+	hash, err := k.HashExp(k.HashAlgorithm())
+	if err != nil {
+		return nil
+	}
+	return hash.Sexp()
+}
+
+// AsSubject returns k as a Subject which is written as its hash, i.e.
+// k itself, or if full is true as the full key, i.e. a KeySubject.
+func (k *RSAPublicKey) AsSubject(full bool) Subject {
+	if full {
+		if k == nil {
+			return KeySubject{}
+		}
+		return KeySubject{k}
+	}
+	return k
+}
+
+// RSAPublicKey returns the public key associated with k.
+func (k *RSAPrivateKey) RSAPublicKey() *RSAPublicKey {
+	if k == nil {
+		return nil
+	}
+	return &RSAPublicKey{Pk: k.PrivateKey.PublicKey}
+}
+
+// Sexp returns k as an S-expression.
+func (k *RSAPrivateKey) Sexp() sexprs.Sexp {
+	l := sexprs.List{
+		rsaAtom,
+		sexprs.List{sexprs.Atom{Value: []byte("e")}, sexprs.Atom{Value: big.NewInt(int64(k.E)).Bytes()}},
+		sexprs.List{sexprs.Atom{Value: []byte("n")}, sexprs.Atom{Value: k.N.Bytes()}},
+		sexprs.List{sexprs.Atom{Value: []byte("d")}, sexprs.Atom{Value: k.D.Bytes()}},
+	}
+	for i, name := range []string{"p", "q"} {
+		if i < len(k.Primes) {
+			l = append(l, sexprs.List{sexprs.Atom{Value: []byte(name)}, sexprs.Atom{Value: k.Primes[i].Bytes()}})
+		}
+	}
+	return sexprs.List{privateKeyAtom, l}
+}
+
+// Pack returns k's canonical S-expression form.
+func (k *RSAPrivateKey) Pack() []byte {
+	return k.Sexp().Pack()
+}
+
+func (k *RSAPrivateKey) String() string {
+	return k.Sexp().String()
+}
+
+// IsHash always returns false for an RSA private key.
+func (k *RSAPrivateKey) IsHash() bool {
+	return false
+}
+
+// PublicKey always returns nil, as an RSA key has no ECDSA public key;
+// use RSAPublicKey instead.  IsHash distinguishes k from a hash.
+func (k *RSAPrivateKey) PublicKey() *PublicKey {
+	return nil
+}
+
+func (k *RSAPrivateKey) HashExp(algorithm string) (hash Hash, err error) {
+	hash, err = k.HashKey.HashExp(algorithm)
+	if err == nil {
+		return hash, nil
+	}
+	return HashSexp(algorithm, k.RSAPublicKey().Sexp())
+}
+
+func (k *RSAPrivateKey) Hashed(algorithm string) ([]byte, error) {
+	hash, err := k.HashExp(algorithm)
+	return hash.Hash, err
+}
+
+func (k *RSAPrivateKey) SignatureAlgorithm() string {
+	return "rsa-pkcs1-sha256"
+}
+
+func (k *RSAPrivateKey) HashAlgorithm() string {
+	return "sha256"
+}
+
+// Equal returns true if k2 is the same key as k, as
+// RSAPublicKey.Equal.  Two private keys must also share the same
+// private exponent.
+func (k *RSAPrivateKey) Equal(k2 Key) bool {
+	if k == nil || k2 == nil {
+		return false
+	}
+	if k2, ok := k2.(*RSAPrivateKey); ok {
+		return k2 != nil && k.D != nil && k2.D != nil && k.D.Cmp(k2.D) == 0 && k.RSAPublicKey().Equal(k2)
+	}
+	return k.RSAPublicKey().Equal(k2)
+}
+
+// Subject returns the sha256 hash of k's public key.
+func (k *RSAPrivateKey) Subject() sexprs.Sexp {
+	return k.RSAPublicKey().Subject()
+}
+
+// Sign returns k's PKCS #1 v1.5 signature of the sha256 hash of s.
+func (k *RSAPrivateKey) Sign(s sexprs.Sexp) (sig *RSASignature, err error) {
+	hash, err := HashSexp("sha256", s)
+	if err != nil {
+		return nil, err
+	}
+	value, err := rsa.SignPKCS1v15(rand.Reader, &k.PrivateKey, crypto.SHA256, hash.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return &RSASignature{Hash: hash, Principal: k.RSAPublicKey(), Value: value}, nil
+}
+
+// EvalRSASignature converts the S-expression s to an RSASignature, or
+// returns an error.  Its principal must be written out in full, as an
+// RSA public key.
+func EvalRSASignature(s sexprs.Sexp) (sig *RSASignature, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) != 4 || !signatureAtom.Equal(l[0]) {
+		return nil, fmt.Errorf("RSA signature must be of the form (signature HASH PRINCIPAL (rsa-pkcs1-sha256 |...|))")
+	}
+	sig = new(RSASignature)
+	sig.Hash, err = EvalHash(l[1])
+	if err != nil {
+		return nil, err
+	}
+	sig.Principal, err = EvalRSAPublicKey(l[2])
+	if err != nil {
+		return nil, err
+	}
+	value, ok := l[3].(sexprs.List)
+	if !ok || len(value) != 2 || !rsaAtom.Equal(value[0]) {
+		return nil, fmt.Errorf("RSA signature value must be of the form (rsa-pkcs1-sha256 |...|)")
+	}
+	v, ok := value[1].(sexprs.Atom)
+	if !ok {
+		return nil, fmt.Errorf("RSA signature value must be a byte-string")
+	}
+	sig.Value = v.Value
+	return sig, nil
+}
+
+// isRSASignature returns true if the signature l is by an RSA key,
+// i.e. if its value is of the form (rsa-pkcs1-sha256 |...|).
+func isRSASignature(l sexprs.List) bool {
+	if len(l) != 4 {
+		return false
+	}
+	value, ok := l[3].(sexprs.List)
+	return ok && len(value) > 0 && rsaAtom.Equal(value[0])
+}
+
+// Sexp returns an S-expression fully representing sig.
+func (sig *RSASignature) Sexp() sexprs.Sexp {
+	return sexprs.List{
+		signatureAtom,
+		sig.Hash.Sexp(),
+		sig.Principal.Sexp(),
+		sexprs.List{rsaAtom, sexprs.Atom{Value: sig.Value}},
+	}
+}
+
+// Pack returns the canonical S-expression form of sig.
+func (sig *RSASignature) Pack() []byte {
+	return sig.Sexp().Pack()
+}
+
+// String is a shortcut for sig.Sexp().String()
+func (sig *RSASignature) String() string {
+	return sig.Sexp().String()
+}
+
+// Verify checks that sig is a valid signature of s by sig.Principal,
+// returning nil if it is and an error describing the problem if it is
+// not.
+func (sig *RSASignature) Verify(s sexprs.Sexp) error {
+	if sig.Principal == nil {
+		return fmt.Errorf("Signature has no principal")
+	}
+	if sig.Hash.Algorithm != "sha256" {
+		return fmt.Errorf("RSA signatures must be of sha256 hashes, not %s", sig.Hash.Algorithm)
+	}
+	if !sig.Hash.VerifySexp(s) {
+		return fmt.Errorf("Signature hash does not match signed object")
+	}
+	return rsa.VerifyPKCS1v15(&sig.Principal.Pk, crypto.SHA256, sig.Hash.Hash, sig.Value)
+}
+
+// signer returns sig's principal.
+func (sig *RSASignature) signer() Key {
+	if sig.Principal == nil {
+		return nil
+	}
+	return sig.Principal
+}
+
+var (
+	_ Key             = (*RSAPublicKey)(nil)
+	_ Key             = (*RSAPrivateKey)(nil)
+	_ Subject         = (*RSAPublicKey)(nil)
+	_ Subject         = (*RSAPrivateKey)(nil)
+	_ SequenceElement = (*RSASignature)(nil)
+)
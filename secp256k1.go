@@ -0,0 +1,40 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+//go:build secp256k1
+// +build secp256k1
+
+package spki
+
+import (
+	"crypto/ecdsa"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secp256k1ecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"math/big"
+)
+
+// Building with the secp256k1 tag registers the Koblitz curve used by
+// Bitcoin & friends under the SPKI curve name "secp256k1", using
+// Decred's implementation.  Without the tag the package does not
+// depend upon it.
+func init() {
+	RegisterCurve("secp256k1", secp256k1.S256(), "sha256")
+	registerDeterministicSigner(secp256k1.S256(), signSecp256k1)
+}
+
+// signSecp256k1 signs digest with priv using Decred's constant-time
+// RFC 6979 signer, which the standard library lacks for secp256k1.
+func signSecp256k1(priv *ecdsa.PrivateKey, digest []byte) (r, s *big.Int, err error) {
+	var d [32]byte
+	priv.D.FillBytes(d[:])
+	key := secp256k1.PrivKeyFromBytes(d[:])
+	defer key.Zero()
+	for i := range d {
+		d[i] = 0
+	}
+	sig := secp256k1ecdsa.Sign(key, digest)
+	sigR, sigS := sig.R(), sig.S()
+	rb, sb := sigR.Bytes(), sigS.Bytes()
+	return new(big.Int).SetBytes(rb[:]), new(big.Int).SetBytes(sb[:]), nil
+}
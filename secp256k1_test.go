@@ -0,0 +1,94 @@
+//go:build secp256k1
+// +build secp256k1
+
+package spki
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/eadmund/sexprs"
+	"testing"
+)
+
+func TestSecp256k1(t *testing.T) {
+	kk, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := PrivateKey{HashKey{}, *kk}
+	sexp, _, err := sexprs.Parse(key.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	evalKey, err := EvalPrivateKey(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evalKey.Curve != secp256k1.S256() || evalKey.D.Cmp(key.D) != 0 {
+		t.Fatal("secp256k1 key did not survive a round-trip")
+	}
+	publicKey, err := EvalPublicKey(key.PublicKey().Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig, err := evalKey.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Hash.Algorithm != "sha256" {
+		t.Fatal("secp256k1 signatures should use sha256, not", sig.Hash.Algorithm)
+	}
+	sig.Principal = publicKey
+	if err = sig.Verify(message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeneratePrivateKey_Secp256k1(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve secp256k1))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Curve != secp256k1.S256() {
+		t.Fatal("Generated key is not on secp256k1")
+	}
+	publicKey, err := EvalPublicKey(key.PublicKey().Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKey.Equal(key) {
+		t.Error("secp256k1 public key did not survive a round-trip")
+	}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig, err := key.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sig.Verify(message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrivateKey_SignDeterministicSecp256k1(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve secp256k1))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig1, err := key.SignDeterministic(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := key.SignDeterministic(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig1.R.Cmp(sig2.R) != 0 || sig1.S.Cmp(sig2.S) != 0 {
+		t.Error("Deterministic signatures differ")
+	}
+	if err = sig1.Verify(message); err != nil {
+		t.Fatal(err)
+	}
+}
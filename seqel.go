@@ -1,7 +1,10 @@
 package spki
 
 import (
+	"fmt"
 	"github.com/eadmund/sexprs"
+	"sort"
+	"strings"
 )
 
 type SequenceElement interface {
@@ -22,6 +25,159 @@ func (seq Sequence) Sexp() sexprs.Sexp {
 	return s
 }
 
+// Pack returns seq's canonical S-expression form.
+func (seq Sequence) Pack() []byte {
+	return seq.Sexp().Pack()
+}
+
 func (seq Sequence) String() string {
 	return seq.Sexp().String()
 }
+
+// Coverage reports which of seq's elements are signed, and by whom.
+// It maps the index of each element which is not itself a signature
+// to the principals of those signatures in seq which are of that
+// element and which verify.  Elements no signature covers are absent.
+func (seq Sequence) Coverage() map[int][]Key {
+	return seq.verify().coverage()
+}
+
+// SignedBy returns the distinct principals of those signatures in seq,
+// ECDSA or RSA, which are of, and verify against, some other element of
+// seq, in the order in which they first sign in seq.  This is useful
+// for bundles co-signed by several issuers.
+func (seq Sequence) SignedBy() []Key {
+	var covering []Key
+	for _, keys := range seq.verify().coverage() {
+		covering = append(covering, keys...)
+	}
+	var signers []Key
+	for _, elt := range seq {
+		sig, ok := elt.(sequenceSignature)
+		if !ok {
+			continue
+		}
+		if k := sig.signer(); signedBy(covering, k) && !signedBy(signers, k) {
+			signers = append(signers, k)
+		}
+	}
+	return signers
+}
+
+// A sequenceSignature is a signature which may appear in a Sequence,
+// e.g. a *Signature or an *RSASignature.
+type sequenceSignature interface {
+	SequenceElement
+	Verify(s sexprs.Sexp) error
+	signer() Key
+}
+
+// A SequenceError is returned by Sequence.Verify when some of the
+// signatures in a sequence do not verify.  Errors maps the index of
+// each such signature to the reason it failed.
+type SequenceError struct {
+	Errors map[int]error
+}
+
+func (e SequenceError) Error() string {
+	var indices []int
+	for i := range e.Errors {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	var failures []string
+	for _, i := range indices {
+		failures = append(failures, fmt.Sprintf("element %d: %s", i, e.Errors[i]))
+	}
+	return fmt.Sprintf("Sequence signatures do not verify (%s)", strings.Join(failures, "; "))
+}
+
+// Verify checks every signature in seq against the element it signs:
+// the nearest preceding element which is not a signature and which it
+// verifies against, e.g. the certificate immediately before it.  It
+// returns nil if every signature verifies, or else a SequenceError
+// listing those which do not.
+func (seq Sequence) Verify() error {
+	return seq.verify().err()
+}
+
+// A verification checks the signatures in a sequence against its other
+// elements only as Verify or Coverage needs them, remembering each
+// result, so that answering both verifies no signature against any
+// element twice while Verify alone still stops at the first element a
+// signature verifies against.
+type verification struct {
+	seq     Sequence
+	results map[[2]int]error // by signature, then element, index
+}
+
+func (seq Sequence) verify() *verification {
+	return &verification{seq, make(map[[2]int]error)}
+}
+
+// result returns the result of verifying the signature at index i of
+// v's sequence against the element at index j.
+func (v *verification) result(i, j int) error {
+	key := [2]int{i, j}
+	if err, ok := v.results[key]; ok {
+		return err
+	}
+	err := v.seq[i].(sequenceSignature).Verify(v.seq[j].Sexp())
+	v.results[key] = err
+	return err
+}
+
+func isSignature(elt SequenceElement) bool {
+	_, ok := elt.(sequenceSignature)
+	return ok
+}
+
+// coverage returns v's results as Sequence.Coverage does.
+func (v *verification) coverage() map[int][]Key {
+	coverage := make(map[int][]Key)
+	for i, elt := range v.seq {
+		if !isSignature(elt) {
+			continue
+		}
+		for j := range v.seq {
+			if !isSignature(v.seq[j]) && v.result(i, j) == nil {
+				coverage[j] = append(coverage[j], elt.(sequenceSignature).signer())
+			}
+		}
+	}
+	return coverage
+}
+
+// err returns v's results as Sequence.Verify does.
+func (v *verification) err() error {
+	failures := make(map[int]error)
+	for i, elt := range v.seq {
+		if !isSignature(elt) {
+			continue
+		}
+		var err error
+		verified := false
+		for j := i - 1; j >= 0 && !verified; j-- {
+			if isSignature(v.seq[j]) {
+				continue
+			}
+			if jErr := v.result(i, j); jErr == nil {
+				verified = true
+			} else if err == nil {
+				// report why the signature failed to verify
+				// the element nearest to it
+				err = jErr
+			}
+		}
+		if !verified {
+			if err == nil {
+				err = fmt.Errorf("Signature has no preceding element to sign")
+			}
+			failures[i] = err
+		}
+	}
+	if len(failures) > 0 {
+		return SequenceError{failures}
+	}
+	return nil
+}
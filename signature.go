@@ -6,32 +6,51 @@ package spki
 
 import (
 	"bytes"
-	//"crypto/ecdsa"
+	"crypto/ecdsa"
+	"encoding/asn1"
 	//"crypto/elliptic"
 	//"crypto/sha256"
 	//"crypto/sha512"
 	"fmt"
 	"github.com/eadmund/sexprs"
-	//"hash"
+	"hash"
+	"io"
 	"math/big"
 	//"net/url"
+	"strings"
 )
 
-// Signature represents an ECDSA signature.  Neither DSA nor RSA are
-// currently supported.  Should RSA be supported, expect Signature to
-// become an interface.
+// Signature represents an ECDSA signature; RSA signatures are
+// represented by RSASignature.  DSA is not supported.
 type Signature struct {
 	Hash      Hash
 	Principal *PublicKey
 	R, S      *big.Int
 }
 
+// A HashNotFoundError is returned when no key could be found for a
+// hash.  Tried lists the hash algorithms under which it was looked up.
 type HashNotFoundError struct {
-	Hash Hash
+	Hash  Hash
+	Tried []string
 }
 
 func (h HashNotFoundError) Error() string {
-	return fmt.Sprintf("Hash value %s not found", h.Hash)
+	if len(h.Tried) == 0 {
+		return fmt.Sprintf("Hash value %s not found", h.Hash)
+	}
+	return fmt.Sprintf("Hash value %s not found (tried %s)", h.Hash, strings.Join(h.Tried, ", "))
+}
+
+// A CurveMismatchError is returned by Verify when a signature's R & S
+// values cannot have been generated on its principal's curve, e.g. when
+// a P384 signature claims a P256 key as its principal.
+type CurveMismatchError struct {
+	Curve string // the name of the principal's curve
+}
+
+func (c CurveMismatchError) Error() string {
+	return fmt.Sprintf("Signature value is too large for principal's curve %s", c.Curve)
 }
 
 var (
@@ -45,6 +64,27 @@ var (
 // If PRINCIPAL is a hash, lookupFunc is used to look it up; if it is nil
 // or returns nil, then EvalSignature returns a HashNotFoundError.
 func EvalSignature(s sexprs.Sexp, lookupFunc func(Hash) *PublicKey) (sig *Signature, err error) {
+	u, err := EvalSignatureDeferred(s)
+	if err != nil {
+		return nil, err
+	}
+	return u.Resolve(lookupFunc)
+}
+
+// An UnresolvedSignature is an ECDSA signature whose principal may be
+// just the hash of a key, as a HashKey, which has yet to be looked up.
+// It allows a signature to be parsed & stored before its principal's
+// key is available.
+type UnresolvedSignature struct {
+	Hash      Hash
+	Principal Key // a *PublicKey or a HashKey
+	R, S      *big.Int
+}
+
+// EvalSignatureDeferred converts a signature S-expression, as
+// EvalSignature, to an UnresolvedSignature, without looking up its
+// principal: a principal which is a hash is retained as a HashKey.
+func EvalSignatureDeferred(s sexprs.Sexp) (sig *UnresolvedSignature, err error) {
 	l, ok := s.(sexprs.List)
 	if !ok {
 		return nil, fmt.Errorf("Signature S-expression must be a list")
@@ -53,36 +93,14 @@ func EvalSignature(s sexprs.Sexp, lookupFunc func(Hash) *PublicKey) (sig *Signat
 		return nil, fmt.Errorf("Signature S-expression must be of the form (signature (hash sha256 |...|) PRINCIPAL (ecdsa |...| |...|))")
 	}
 
-	sig = new(Signature)
+	sig = new(UnresolvedSignature)
 	sig.Hash, err = EvalHash(l[1])
 	if err != nil {
 		return nil, err
 	}
-	principal, ok := l[2].(sexprs.List)
-	if !ok {
-		return nil, fmt.Errorf("Principal must be either a hash or a public key")
-	}
-	principalFirst, ok := principal[0].(sexprs.Atom)
-	if !ok {
-		return nil, fmt.Errorf("Principal must be either a hash or a public key")
-	}
-	switch string(principalFirst.Value) {
-	case "hash":
-		hash, err := EvalHash(principal)
-		if err != nil {
-			return nil, err
-		}
-		sig.Principal = lookupFunc(hash)
-		if sig.Principal == nil {
-			return nil, HashNotFoundError{hash}
-		}
-	case "public-key":
-		sig.Principal, err = EvalPublicKey(principal)
-		if err != nil {
-			return nil, err
-		}
-	default:
-		return nil, fmt.Errorf("Principal must be either a hash or a public key")
+	sig.Principal, err = evalPrincipal(l[2])
+	if err != nil {
+		return nil, err
 	}
 	sigVal, ok := l[3].(sexprs.List)
 	if !ok || len(sigVal) != 3 {
@@ -96,28 +114,88 @@ func EvalSignature(s sexprs.Sexp, lookupFunc func(Hash) *PublicKey) (sig *Signat
 	if err != nil {
 		return nil, err
 	}
-	sig.S, err = evalNamedBigInt("s", sigVal[1])
+	sig.S, err = evalNamedBigInt("s", sigVal[2])
 	if err != nil {
 		return nil, err
 	}
 	return sig, nil
 }
 
+// Resolve returns u as a Signature.  If u's principal is a HashKey,
+// lookupFunc is used to look up its key; if it is nil or returns nil,
+// then Resolve returns a HashNotFoundError.
+func (u *UnresolvedSignature) Resolve(lookupFunc func(Hash) *PublicKey) (sig *Signature, err error) {
+	sig = &Signature{Hash: u.Hash, R: u.R, S: u.S}
+	switch principal := u.Principal.(type) {
+	case *PublicKey:
+		sig.Principal = principal
+	case HashKey:
+		if len(principal.Hashes) == 0 {
+			return nil, fmt.Errorf("Principal has no hash")
+		}
+		hash := principal.Hashes[0]
+		if lookupFunc != nil {
+			sig.Principal = lookupFunc(hash)
+		}
+		if sig.Principal == nil {
+			return nil, HashNotFoundError{hash, []string{hash.Algorithm}}
+		}
+	default:
+		return nil, fmt.Errorf("Principal must be either a hash or a public key")
+	}
+	if err = sig.checkLength(); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// Sexp returns an S-expression fully representing u.
+func (u *UnresolvedSignature) Sexp() sexprs.Sexp {
+	return signatureSexp(u.Hash, u.Principal.Sexp(), u.R, u.S)
+}
+
+func (u *UnresolvedSignature) String() string {
+	return u.Sexp().String()
+}
+
+// checkLength returns an error if either of R or S is longer than the
+// field size of the principal's curve, which can only be the result of
+// corruption.
+func (sig *Signature) checkLength() error {
+	curve := sig.Principal.Pk.Curve
+	if curve == nil {
+		return fmt.Errorf("Principal has no curve")
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(sig.R.Bytes()) > size {
+		return fmt.Errorf("Signature R value is longer than %d bytes", size)
+	}
+	if len(sig.S.Bytes()) > size {
+		return fmt.Errorf("Signature S value is longer than %d bytes", size)
+	}
+	return nil
+}
+
 // Sexp returns an S-expression fully representing sig
 func (sig *Signature) Sexp() sexprs.Sexp {
+	return signatureSexp(sig.Hash, sig.Principal.Sexp(), sig.R, sig.S)
+}
+
+// signatureSexp returns an ECDSA signature S-expression.
+func signatureSexp(hash Hash, principal sexprs.Sexp, r, s *big.Int) sexprs.Sexp {
 	l := sexprs.List{
-		sexprs.Atom{Value: []byte("signature")},
-		sig.Hash.Sexp(),
-		sig.Principal.Sexp(),
+		signatureAtom,
+		hash.Sexp(),
+		principal,
 		sexprs.List{
 			sexprs.Atom{Value: []byte("ecdsa-sha2")},
 			sexprs.List{
 				sexprs.Atom{Value: []byte("r")},
-				sexprs.Atom{Value: sig.R.Bytes()},
+				sexprs.Atom{Value: r.Bytes()},
 			},
 			sexprs.List{
 				sexprs.Atom{Value: []byte("s")},
-				sexprs.Atom{Value: sig.S.Bytes()},
+				sexprs.Atom{Value: s.Bytes()},
 			},
 		},
 	}
@@ -125,7 +203,158 @@ func (sig *Signature) Sexp() sexprs.Sexp {
 
 }
 
+// Equal returns true if sig & other are the same signature: of the
+// same hash, by the same principal and with the same value.  Two nil
+// signatures are equal.
+func (sig *Signature) Equal(other *Signature) bool {
+	if sig == nil || other == nil {
+		return sig == other
+	}
+	switch {
+	case !sig.Hash.Equal(other.Hash):
+		return false
+	case sig.Principal == nil || other.Principal == nil:
+		if sig.Principal != other.Principal {
+			return false
+		}
+	case !sig.Principal.Equal(other.Principal):
+		return false
+	}
+	return intEqual(sig.R, other.R) && intEqual(sig.S, other.S)
+}
+
+func intEqual(a, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Cmp(b) == 0
+}
+
+// Pack returns the canonical S-expression form of sig.
+func (sig *Signature) Pack() []byte {
+	return sig.Sexp().Pack()
+}
+
 // String is a shortcut for sig.Sexp().String()
 func (sig *Signature) String() string {
 	return sig.Sexp().String()
 }
+
+// signer returns sig's principal.
+func (sig *Signature) signer() Key {
+	if sig.Principal == nil {
+		return nil
+	}
+	return sig.Principal
+}
+
+// Verify checks that sig is a valid signature of s by sig.Principal,
+// returning nil if it is and an error describing the problem if it is
+// not.  A signature whose R or S lies outside of the principal's curve
+// yields a CurveMismatchError.
+func (sig *Signature) Verify(s sexprs.Sexp) error {
+	hasher, err := sig.hasher()
+	if err != nil {
+		return err
+	}
+	_, err = hasher.Write(Canonicalize(s))
+	if err != nil {
+		return err
+	}
+	return sig.verifyDigest(hasher.Sum(nil))
+}
+
+// VerifyReader checks that sig is a valid signature of the bytes read
+// from r, which are hashed as they are read rather than being held in
+// memory.  This is useful for verifying detached signatures of large
+// objects.  ok is true exactly when err is nil.
+func (sig *Signature) VerifyReader(r io.Reader) (ok bool, err error) {
+	hasher, err := sig.hasher()
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(hasher, r)
+	if err != nil {
+		return false, err
+	}
+	err = sig.verifyDigest(hasher.Sum(nil))
+	return err == nil, err
+}
+
+func (sig *Signature) hasher() (hash.Hash, error) {
+	if sig.Principal == nil {
+		return nil, fmt.Errorf("Signature has no principal")
+	}
+	newHash, ok := knownHash(sig.Hash.Algorithm)
+	if !ok {
+		return nil, fmt.Errorf("Unknown hash algorithm %s", sig.Hash.Algorithm)
+	}
+	return newHash(), nil
+}
+
+// verifyDigest checks that digest is the digest sig claims to have
+// signed, and that it was indeed signed by sig.Principal.
+func (sig *Signature) verifyDigest(digest []byte) error {
+	if !bytes.Equal(digest, sig.Hash.Hash) {
+		return fmt.Errorf("Signature hash does not match signed object")
+	}
+	if err := sig.checkCurve(); err != nil {
+		return err
+	}
+	if !ecdsa.Verify(&sig.Principal.Pk, sig.Hash.Hash, sig.R, sig.S) {
+		return fmt.Errorf("Signature does not verify")
+	}
+	return nil
+}
+
+// checkCurve returns a CurveMismatchError if either of R or S is
+// out of range for the principal's curve.  Since the ECDSA signature
+// value does not itself name its curve, this is the best indication we
+// have that a signature was made with a key on some other curve.
+func (sig *Signature) checkCurve() error {
+	curve := sig.Principal.Pk.Curve
+	if curve == nil {
+		return fmt.Errorf("Principal has no curve")
+	}
+	if sig.R == nil || sig.S == nil {
+		return fmt.Errorf("Signature value is incomplete")
+	}
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
+		return fmt.Errorf("Signature value must be positive")
+	}
+	n := curve.Params().N
+	if sig.R.Cmp(n) >= 0 || sig.S.Cmp(n) >= 0 {
+		return CurveMismatchError{curve.Params().Name}
+	}
+	return nil
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature value,
+// as specified in RFC 3279.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// DER returns the ASN.1 DER encoding of sig's value, SEQUENCE { r, s },
+// as used by X.509 & other ASN.1-based tools.  It omits the hash &
+// principal, which such tools convey separately.
+func (sig *Signature) DER() ([]byte, error) {
+	if sig.R == nil || sig.S == nil {
+		return nil, fmt.Errorf("Signature value is incomplete")
+	}
+	return asn1.Marshal(ecdsaSignature{sig.R, sig.S})
+}
+
+// SignatureFromDER returns the Signature by principal of h whose
+// value has the ASN.1 DER encoding der.
+func SignatureFromDER(der []byte, principal *PublicKey, h Hash) (sig *Signature, err error) {
+	var value ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &value)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("Trailing data after DER signature")
+	}
+	return &Signature{Hash: h, Principal: principal, R: value.R, S: value.S}, nil
+}
@@ -11,6 +11,11 @@
 //
 // I'm indebted to Inferno's spki(2), whose API I have deliberately
 // mimicked, making it more Go-like as seemed meet.
+//
+// Keys on the NIST curves p256 & p384 are always supported.  Building
+// with the secp256k1 tag adds the curve of that name, as used by
+// Bitcoin & other blockchains, e.g. (ecdsa-sha2 (curve secp256k1)); it
+// makes the package depend upon github.com/decred/dcrd/dcrec/secp256k1.
 package spki
 
 import (
@@ -23,6 +28,15 @@ import (
 
 type URIs []*url.URL
 
+// Sexp returns u as a (uris ...) S-expression.
+func (u URIs) Sexp() sexprs.Sexp {
+	s := sexprs.List{urisAtom}
+	for _, uri := range u {
+		s = append(s, sexprs.Atom{Value: []byte(uri.String())})
+	}
+	return s
+}
+
 func EvalURIs(s sexprs.Sexp) (u URIs, err error) {
 	switch s := s.(type) {
 	case sexprs.List:
@@ -41,10 +55,35 @@ func EvalURIs(s sexprs.Sexp) (u URIs, err error) {
 			}
 			return u, nil
 		}
+		return nil, fmt.Errorf("URIs must be of the form (uris URI+)")
 	default:
 		return nil, fmt.Errorf("S-expression not a list")
 	}
-	panic("Can't reach here")
+}
+
+// Canonicalize returns the canonical form of s used whenever it is
+// hashed or signed: its canonical packed encoding, with any display
+// hints stripped and any nil elements of lists omitted.  Two
+// expressions which differ only in how they were written therefore
+// canonicalise identically.
+func Canonicalize(s sexprs.Sexp) []byte {
+	return canonicalSexp(s).Pack()
+}
+
+func canonicalSexp(s sexprs.Sexp) sexprs.Sexp {
+	switch s := s.(type) {
+	case sexprs.Atom:
+		return sexprs.Atom{Value: s.Value}
+	case sexprs.List:
+		l := make(sexprs.List, 0, len(s))
+		for _, elt := range s {
+			if elt != nil {
+				l = append(l, canonicalSexp(elt))
+			}
+		}
+		return l
+	}
+	return s
 }
 
 func evalNamedBigInt(name string, s sexprs.Sexp) (n *big.Int, err error) {
@@ -56,11 +95,9 @@ func evalNamedBigInt(name string, s sexprs.Sexp) (n *big.Int, err error) {
 	if !ok || !bytes.Equal(first.Value, []byte(name)) {
 		return nil, fmt.Errorf("Expected term name %s %v %v", name, ok, first)
 	}
-	if raw, ok := l[1].(sexprs.Atom); !ok {
+	raw, ok := l[1].(sexprs.Atom)
+	if !ok {
 		return nil, fmt.Errorf("Value in (%s VALUE) must be an atom", name)
-	} else {
-		n = big.NewInt(0).SetBytes(raw.Value)
-		return n, nil
 	}
-	panic("Can't get here")
+	return big.NewInt(0).SetBytes(raw.Value), nil
 }
@@ -1,12 +1,29 @@
 package spki
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/eadmund/sexprs"
+	"hash"
+	"io"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -38,6 +55,13 @@ func TestHash(t *testing.T) {
 	if h1.URIs == nil {
 		t.Fatal("No URIs for URI-having hash")
 	}
+	h2, err = EvalHash(h1.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h2.URIs) != 1 || h2.URIs[0].String() != "http://example.com" {
+		t.Fatal("URIs did not survive a round-trip", h2.URIs)
+	}
 	//t.Log(h1.URIs)
 	//t.Log(h.Sexp())
 }
@@ -139,3 +163,4205 @@ func TestPrivateKey_IssueAuthCert(t *testing.T) {
 	}
 	_ = Sequence{cert, sig}
 }
+
+func TestSignature_Verify(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig, err := key.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sig.Verify(message); err != nil {
+		t.Fatal(err)
+	}
+	if err = sig.Verify(sexprs.Atom{Value: []byte("Some other message")}); err == nil {
+		t.Fatal("Signature verified a different message")
+	}
+}
+
+func TestSignature_VerifyCurveMismatch(t *testing.T) {
+	kk, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := PrivateKey{HashKey{}, *kk}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig, err := key.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend that the P384 signature was made by a P256 key; its R
+	// and S are far too large for that curve.
+	p256Key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Principal = p256Key.PublicKey()
+	for sig.R.Cmp(elliptic.P256().Params().N) < 0 && sig.S.Cmp(elliptic.P256().Params().N) < 0 {
+		// vanishingly unlikely, but possible
+		if sig, err = key.Sign(message); err != nil {
+			t.Fatal(err)
+		}
+		sig.Principal = p256Key.PublicKey()
+	}
+	err = sig.Verify(message)
+	if _, ok := err.(CurveMismatchError); !ok {
+		t.Fatalf("Expected a CurveMismatchError; got %v", err)
+	}
+}
+
+func TestHashObject(t *testing.T) {
+	data := []byte("This is a test; it is only a test")
+	h, err := HashObject("sha256", data, "http://example.com/test", "ftp://example.org/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sha256.Sum256(data)
+	if !bytes.Equal(h.Hash, expected[:]) {
+		t.Fatalf("Expected digest %x; got %x", expected, h.Hash)
+	}
+	if len(h.URIs) != 2 || h.URIs[0].String() != "http://example.com/test" || h.URIs[1].String() != "ftp://example.org/test" {
+		t.Fatal("URIs not attached to hash", h.URIs)
+	}
+	h2, err := EvalHash(h.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Equal(h2) {
+		t.Fatal("Hash did not survive a round-trip", h, h2)
+	}
+	if len(h2.URIs) != 2 || h2.URIs[0].String() != h.URIs[0].String() || h2.URIs[1].String() != h.URIs[1].String() {
+		t.Fatal("URIs did not survive a round-trip", h2.URIs)
+	}
+	if _, err = HashObject("md5", data); err == nil {
+		t.Fatal("HashObject accepted an unknown algorithm")
+	}
+	if _, err = HashObject("sha256", data, "http://[::1"); err == nil {
+		t.Fatal("HashObject accepted an invalid URI")
+	}
+}
+
+func TestSignature_Length(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(key.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sig.checkLength(); err != nil {
+		t.Fatal(err)
+	}
+	sig.R = big.NewInt(0).SetBytes(bytes.Repeat([]byte{0xff}, 33))
+	if err = sig.checkLength(); err == nil {
+		t.Fatal("Over-length R accepted")
+	}
+}
+
+func TestHashSize(t *testing.T) {
+	sizes := map[string]int{"sha224": 28, "sha256": 32, "sha384": 48, "sha512": 64}
+	for algorithm, size := range sizes {
+		if !ValidHashAlgorithm(algorithm) {
+			t.Error("Known algorithm not valid", algorithm)
+		}
+		if s, ok := HashSize(algorithm); !ok || s != size {
+			t.Errorf("Expected %s digests to be %d bytes; got %d", algorithm, size, s)
+		}
+	}
+	if ValidHashAlgorithm("md5") {
+		t.Error("Unknown algorithm md5 is valid")
+	}
+	if _, ok := HashSize("md5"); ok {
+		t.Error("Unknown algorithm md5 has a size")
+	}
+}
+
+func TestValid_SexpUTC(t *testing.T) {
+	zone := time.FixedZone("UTC-7", -7*60*60)
+	notBefore := time.Date(2014, time.January, 1, 17, 30, 0, 0, zone)
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, zone)
+	v := Valid{NotBefore: &notBefore, NotAfter: &notAfter}
+	l := v.Sexp().(sexprs.List)
+	for i, expected := range []struct {
+		str string
+		t   time.Time
+	}{{"2014-01-02_00:30:00", notBefore}, {"2015-01-01_06:59:00", notAfter}} {
+		value := l[i+1].(sexprs.List)[1].(sexprs.Atom).Value
+		if string(value) != expected.str {
+			t.Errorf("Expected %s; got %s", expected.str, value)
+		}
+		parsed, err := time.Parse(V0DateFmt, string(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(expected.t) {
+			t.Errorf("Expected %v; got %v", expected.t, parsed)
+		}
+	}
+}
+
+func TestPublicKey_PreferredHash(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := key.PublicKey()
+	publicKey.PreferredHash = "sha512"
+	sexp, _, err := sexprs.Parse(publicKey.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	evalKey, err := EvalPublicKey(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evalKey.PreferredHash != "sha512" {
+		t.Fatal("Preferred hash algorithm not preserved", evalKey.PreferredHash)
+	}
+	hash, err := evalKey.HashExp("sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !evalKey.Subject().Equal(hash.Sexp()) {
+		t.Fatal("Subject does not use preferred hash algorithm", evalKey.Subject())
+	}
+}
+
+// A key's preferred hash is a hint, not part of its identity.
+func TestPublicKey_PreferredHashIdentity(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.PublicKey()
+	hinted := key.PublicKey()
+	hinted.PreferredHash = "sha512"
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		hash, err := pub.HashExp(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(HashKey{[]Hash{hash}}).Equal(hinted) {
+			t.Errorf("%s hash of %s does not match the key with a hint", algorithm, pub)
+		}
+	}
+	ks := NewKeyStore()
+	if err := ks.Add(pub); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hinted.HashExp("sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := ks.Lookup(hash); !pub.Equal(found) {
+		t.Errorf("Expected %s; got %s", pub, found)
+	}
+
+	// a certificate to the hinted key chains to one issued by it
+	issuer, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert1 := testCert(t, issuer, hinted, "(dns (* prefix com.example.))")
+	cert2 := testCert(t, key, other.PublicKey(), "(dns (* prefix com.example.www.))")
+	if _, err := Reduce([]*AuthCert{&cert1, &cert2}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignature_VerifyReader(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4<<20)
+	if _, err = rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashObject("sha256", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.sign(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := sig.VerifyReader(bytes.NewReader(data))
+	if !ok || err != nil {
+		t.Fatal("Signature did not verify", err)
+	}
+	data[len(data)-1] ^= 1
+	ok, err = sig.VerifyReader(bytes.NewReader(data))
+	if ok || err == nil {
+		t.Fatal("Signature verified altered data")
+	}
+}
+
+func TestAuthCert_SemanticEqual(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, _, err := sexprs.Parse([]byte("(dns (* prefix com.example.))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	validity := Valid{NotAfter: &notAfter}
+	cert1 := key.IssueAuthCert(key.PublicKey(), tag, validity)
+	cert2 := key.IssueAuthCert(key.PublicKey(), tag, validity)
+	// as if cert2 had been parsed from an expression with a comment
+	cert2.Expr = append(cert1.Sexp().(sexprs.List), sexprs.List{sexprs.Atom{Value: []byte("comment")}, sexprs.Atom{Value: []byte("A test certificate")}})
+	if cert1.Sexp().Equal(cert2.Sexp()) {
+		t.Fatal("Certificates with and without comments are identical")
+	}
+	if !cert1.SemanticEqual(&cert2) {
+		t.Fatal("Certificates differing only in comment are not SemanticEqual")
+	}
+	otherTag, _, err := sexprs.Parse([]byte("(dns (* prefix org.example.))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert3 := key.IssueAuthCert(key.PublicKey(), otherTag, validity)
+	if cert1.SemanticEqual(&cert3) {
+		t.Fatal("Certificates with differing tags are SemanticEqual")
+	}
+	cert4 := key.IssueAuthCert(key.PublicKey(), tag, Valid{})
+	if cert1.SemanticEqual(&cert4) {
+		t.Fatal("Certificates with differing validity are SemanticEqual")
+	}
+}
+
+func TestGenerateP256KeyFromSeed(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x2a}, MinSeedSize)
+	key1, err := GenerateP256KeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := GenerateP256KeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1.D.Cmp(key2.D) != 0 || key1.X.Cmp(key2.X) != 0 || key1.Y.Cmp(key2.Y) != 0 {
+		t.Fatal("Same seed yielded different keys")
+	}
+	if !key1.Curve.IsOnCurve(key1.X, key1.Y) {
+		t.Fatal("Generated public point is not on the curve")
+	}
+	seed[0] ^= 1
+	key3, err := GenerateP256KeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1.D.Cmp(key3.D) == 0 {
+		t.Fatal("Different seeds yielded the same key")
+	}
+	sig, err := key3.Sign(key3.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sig.Verify(key3.Sexp()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GenerateP256KeyFromSeed(seed[:MinSeedSize-1]); err == nil {
+		t.Fatal("Short seed accepted")
+	}
+}
+
+// testCert returns a simple delegating certificate from issuer to
+// subject.
+func testCert(t *testing.T, issuer *PrivateKey, subject *PublicKey, tag string) AuthCert {
+	sexp, _, err := sexprs.Parse([]byte(tag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	return issuer.IssueAuthCert(subject, sexp, Valid{NotBefore: &notBefore, NotAfter: &notAfter})
+}
+
+func TestSequence_Coverage(t *testing.T) {
+	key1, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert1 := testCert(t, key1, key2.PublicKey(), "(dns (* prefix com.example.))")
+	cert2 := testCert(t, key2, key1.PublicKey(), "(dns (* prefix org.example.))")
+	sig1, err := key1.Sign(cert1.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := key2.Sign(cert2.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := testCert(t, key1, key1.PublicKey(), "(dns (* prefix net.example.))")
+	coverage := Sequence{cert1, sig1, cert2, sig2, unsigned}.Coverage()
+	if len(coverage) != 2 {
+		t.Fatal("Expected two covered elements; got", len(coverage))
+	}
+	if len(coverage[0]) != 1 || coverage[0][0] != sig1.Principal {
+		t.Error("First cert not covered by its issuer", coverage[0])
+	}
+	if len(coverage[2]) != 1 || coverage[2][0] != sig2.Principal {
+		t.Error("Second cert not covered by its issuer", coverage[2])
+	}
+}
+
+func TestEvalSignature_HashNotFound(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(key.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := key.PublicKey().HashExp("sha384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sexp := sig.Sexp().(sexprs.List)
+	sexp[2] = principal.Sexp()
+	for _, lookup := range []func(Hash) *PublicKey{nil, func(Hash) *PublicKey { return nil }} {
+		_, err = EvalSignature(sexp, lookup)
+		notFound, ok := err.(HashNotFoundError)
+		if !ok {
+			t.Fatal("Expected a HashNotFoundError; got", err)
+		}
+		if !notFound.Hash.Equal(principal) || len(notFound.Tried) != 1 || notFound.Tried[0] != "sha384" {
+			t.Fatal("HashNotFoundError does not describe lookup", notFound)
+		}
+	}
+}
+
+// otherSubject is a certificate subject which is not a key.
+type otherSubject struct{}
+
+func (o otherSubject) Subject() sexprs.Sexp {
+	return sexprs.Atom{Value: []byte("other")}
+}
+
+func TestAuthCert_SubjectKey(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := key.PublicKey()
+	hash, err := publicKey.HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []Subject{publicKey, HashKey{[]Hash{hash}}, hash} {
+		cert := AuthCert{Subject: subject}
+		k, ok := cert.SubjectKey()
+		if !ok {
+			t.Fatalf("Subject %v is not a key", subject)
+		}
+		h, err := k.HashExp("sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Equal(hash) {
+			t.Errorf("Subject key %v has the wrong hash", k)
+		}
+	}
+	cert := AuthCert{Subject: otherSubject{}}
+	if _, ok := cert.SubjectKey(); ok {
+		t.Error("Non-key subject is a key")
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors from RFC 6979, appendices A.2.5 & A.2.6.
+var scalarTests = []struct {
+	curve, d, x, y string
+}{
+	{"p256",
+		"C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721",
+		"60FED4BA255A9D31C961EB74C6356D68C049B8923B61FA6CE669622E60F29FB6",
+		"7903FE1008B8BC99A41AE9E95628BC64F2F1B20C2D7E9F5177A3C294D4462299"},
+	{"p384",
+		"6B9D3DAD2E1B8C1C05B19875B6659F4DE23C3B667BF297BA9AA47740787137D896D5724E4C70A825F872C9EA60D2EDF5",
+		"EC3A4E415B4E19A4568618029F427FA5DA9A8BC4AE92E02E06AAE5286B300C64DEF8F0EA9055866064A254515480BC13",
+		"8015D9B72D7D57244EA8EF9AC0C621896708A59367F9DFB9F54CA84B3F1C9DB1288B231C3AE0D4FE7344FD2533264720"},
+}
+
+func TestPrivateKeyFromScalar(t *testing.T) {
+	for _, test := range scalarTests {
+		key, err := PrivateKeyFromScalar(test.curve, mustDecodeHex(t, test.d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := PublicKeyFromCoords(test.curve, mustDecodeHex(t, test.x), mustDecodeHex(t, test.y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.PublicKey().Equal(expected) {
+			t.Errorf("%s: expected %v; got %v", test.curve, expected, key.PublicKey())
+		}
+	}
+	if _, err := PrivateKeyFromScalar("p256", nil); err == nil {
+		t.Error("Zero scalar accepted")
+	}
+	if _, err := PrivateKeyFromScalar("p521", []byte{1}); err == nil {
+		t.Error("Unknown curve accepted")
+	}
+	if _, err := PublicKeyFromCoords("p256", []byte{1}, []byte{2}); err == nil {
+		t.Error("Point not on curve accepted")
+	}
+}
+
+func TestSignature_DER(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(key.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := sig.DER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&sig.Principal.Pk, sig.Hash.Hash, der) {
+		t.Fatal("DER signature does not verify")
+	}
+	sig2, err := SignatureFromDER(der, sig.Principal, sig.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.R.Cmp(sig2.R) != 0 || sig.S.Cmp(sig2.S) != 0 {
+		t.Fatal("Signature value did not survive a round-trip")
+	}
+	if err = sig2.Verify(key.Sexp()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SignatureFromDER(der[:len(der)-1], sig.Principal, sig.Hash); err == nil {
+		t.Fatal("Truncated DER accepted")
+	}
+}
+
+func TestPrivateKey_IssueAuthCertToHash(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjectKey, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := subjectKey.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, _, err := sexprs.Parse([]byte("(dns (* prefix com.example.))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []Subject{hash, HashKey{[]Hash{hash}}} {
+		cert := key.IssueAuthCert(subject, tag, Valid{})
+		expected := sexprs.List{sexprs.Atom{Value: []byte("subject")}, hash.Sexp()}
+		if !cert.Sexp().(sexprs.List)[2].Equal(expected) {
+			t.Errorf("Expected subject %v; got %v", expected, cert.Sexp().(sexprs.List)[2])
+		}
+	}
+}
+
+func TestSequence_SignedBy(t *testing.T) {
+	var keys []*PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	cert := testCert(t, keys[0], keys[1].PublicKey(), "(dns (* prefix com.example.))")
+	seq := Sequence{cert}
+	for _, key := range keys {
+		sig, err := key.Sign(cert.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq = append(seq, sig)
+	}
+	// an RSA co-signer counts as much as an ECDSA one
+	rsaKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsaKey.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq = append(seq, rsaSig)
+	// a repeated signature adds no new signer
+	seq = append(seq, seq[1])
+	// nor does a signature of something else
+	stray, err := keys[0].Sign(keys[0].Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq = append(seq, stray)
+	signers := seq.SignedBy()
+	expected := []Key{keys[0].PublicKey(), keys[1].PublicKey(), keys[2].PublicKey(), rsaKey.RSAPublicKey()}
+	if len(signers) != len(expected) {
+		t.Fatalf("Expected %d signers; got %d", len(expected), len(signers))
+	}
+	for i, key := range expected {
+		if !signers[i].Equal(key) {
+			t.Errorf("Expected signer %d to be %v; got %v", i, key, signers[i])
+		}
+	}
+}
+
+func TestName_ResolveSelf(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := &Name{Names: []string{"admin"}}
+	if !self.Sexp().Equal(sexprs.List{sexprs.Atom{Value: []byte("name")}, sexprs.Atom{Value: []byte("Self")}, sexprs.Atom{Value: []byte("admin")}}) {
+		t.Fatal("Unexpected Self name", self)
+	}
+	resolved := self.ResolveSelf(key.PublicKey())
+	if !resolved.Equal(Name{key.PublicKey(), []string{"admin"}}) {
+		t.Fatal("Resolved name is in error", resolved)
+	}
+	other, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resolved.ResolveSelf(other.PublicKey()).Equal(*resolved) {
+		t.Fatal("Resolving a name with a principal changed it")
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	a, _, err := sexprs.Parse([]byte("(cert (issuer [text/plain]alice)  (tag (* prefix |Zm9v|)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := sexprs.Parse([]byte("(4:cert(6:issuer5:alice)(3:tag(1:*6:prefix3:foo)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Equal(b) {
+		t.Fatal("Expressions with and without display hints are Equal")
+	}
+	if !bytes.Equal(Canonicalize(a), Canonicalize(b)) {
+		t.Fatalf("Expected %s & %s to canonicalise identically", Canonicalize(a), Canonicalize(b))
+	}
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	valid := Valid{NotAfter: &notAfter}
+	if string(Canonicalize(valid.Sexp())) != "(5:valid(9:not-after19:2014-12-31_23:59:00))" {
+		t.Fatal("Unexpected canonical validity", string(Canonicalize(valid.Sexp())))
+	}
+}
+
+func TestCertCache(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []Sequence
+	for _, tag := range []string{"(dns com.example.)", "(dns org.example.)", "(dns net.example.)"} {
+		cert := testCert(t, key, key.PublicKey(), tag)
+		sig, err := key.Sign(cert.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, Sequence{cert, sig})
+	}
+	cache := NewCertCache(2)
+	verifications := 0
+	signers := func(seq Sequence) []Key {
+		if result, ok := cache.Get(seq); ok {
+			return result.([]Key)
+		}
+		verifications++
+		result := seq.SignedBy()
+		cache.Put(seq, result)
+		return result
+	}
+	for i := 0; i < 2; i++ {
+		if len(signers(seqs[0])) != 1 {
+			t.Fatal("Sequence not signed")
+		}
+	}
+	if verifications != 1 {
+		t.Fatal("Expected one verification; got", verifications)
+	}
+	for _, seq := range seqs {
+		signers(seq)
+	}
+	if cache.Len() != 2 {
+		t.Fatal("Expected cache to hold 2 results; got", cache.Len())
+	}
+	if _, ok := cache.Get(seqs[0]); ok {
+		t.Fatal("Least-recently-used result not evicted")
+	}
+	if _, ok := cache.Get(seqs[2]); !ok {
+		t.Fatal("Most-recently-used result evicted")
+	}
+	// sequences differing only in a display hint share a result, which
+	// is right for both, since the hint grants nothing
+	hinted := testCert(t, key, key.PublicKey(), "(ftp [text/plain]host)")
+	plain := testCert(t, key, key.PublicKey(), "(ftp host)")
+	reduced, err := Reduce([]*AuthCert{&hinted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(Sequence{hinted}, reduced)
+	result, ok := cache.Get(Sequence{plain})
+	if !ok {
+		t.Fatal("Expected a result for a sequence differing only in a hint")
+	}
+	reduced, err = Reduce([]*AuthCert{&plain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.(*AuthCert).SemanticEqual(reduced) {
+		t.Error("Cached result", result, "differs from", reduced)
+	}
+}
+
+func TestSignature_Pack(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(key.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sexp, rest, err := sexprs.Parse(sig.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 || !sexp.Equal(sig.Sexp()) {
+		t.Fatal("Packed signature does not match its S-expression")
+	}
+	l := sexp.(sexprs.List)
+	if !l[1].Equal(sig.Hash.Sexp()) || !l[2].Equal(key.PublicKey().Sexp()) {
+		t.Fatal("Packed signature has wrong hash or principal", sexp)
+	}
+	value := l[3].(sexprs.List)
+	r, err := evalNamedBigInt("r", value[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := evalNamedBigInt("s", value[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Cmp(sig.R) != 0 || s.Cmp(sig.S) != 0 {
+		t.Fatal("Packed signature value is in error")
+	}
+}
+
+func TestEvalSignature(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig, err := key.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sexp, _, err := sexprs.Parse([]byte(sig.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := EvalSignature(sexp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig2.R.Cmp(sig.R) != 0 || sig2.S.Cmp(sig.S) != 0 {
+		t.Fatal("Signature value did not survive a round-trip")
+	}
+	if sig2.R.Cmp(sig2.S) == 0 {
+		t.Fatal("Parsed S equals R")
+	}
+	if err = sig2.Verify(message); err != nil {
+		t.Fatal(err)
+	}
+	sig.R = big.NewInt(0).SetBytes(bytes.Repeat([]byte{0xff}, 33))
+	if _, err = EvalSignature(sig.Sexp(), nil); err == nil {
+		t.Fatal("EvalSignature accepted an over-length R")
+	}
+}
+
+func TestECDSA384Key(t *testing.T) {
+	x := "EC3A4E415B4E19A4568618029F427FA5DA9A8BC4AE92E02E06AAE5286B300C64DEF8F0EA9055866064A254515480BC13"
+	y := "8015D9B72D7D57244EA8EF9AC0C621896708A59367F9DFB9F54CA84B3F1C9DB1288B231C3AE0D4FE7344FD2533264720"
+	sexp, _, err := sexprs.Parse([]byte("(public-key (ecdsa-sha2 (curve p384) (x #" + x + "#) (y #" + y + "#)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := EvalPublicKey(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Pk.Curve != elliptic.P384() {
+		t.Fatal("Expected a P384 key; got", key.Pk.Curve.Params().Name)
+	}
+	if key.Pk.X.Cmp(new(big.Int).SetBytes(mustDecodeHex(t, x))) != 0 || key.Pk.Y.Cmp(new(big.Int).SetBytes(mustDecodeHex(t, y))) != 0 {
+		t.Fatal("P384 key has the wrong coordinates")
+	}
+	if !key.Sexp().Equal(sexp) {
+		t.Fatal("P384 key did not survive a round-trip")
+	}
+}
+
+func TestEvalCurve(t *testing.T) {
+	for _, test := range []struct {
+		sexp string
+		ok   bool
+	}{
+		{"(curve p256)", true},
+		{"(curve p384)", true},
+		{"(curve p512)", false},
+		{"(curve p521)", false},
+		{"(curve)", false},
+		{"(curve p256 p384)", false},
+		{"(kurve p256)", false},
+	} {
+		sexp, _, err := sexprs.Parse([]byte(test.sexp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		curve, err := evalCurve(sexp)
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%s: %v", test.sexp, err)
+		case !test.ok && err == nil:
+			t.Errorf("%s: accepted as %s", test.sexp, curve)
+		}
+	}
+}
+
+func TestGeneratePrivateKey_Formats(t *testing.T) {
+	for _, algorithm := range []string{
+		"(ecdsa-sha2 (curve p256))",
+		"  ( ecdsa-sha2\n\t(curve  p256) )  ",
+		"(10:ecdsa-sha2(5:curve4:p256))",
+		"(ecdsa-sha2 (curve p384))",
+	} {
+		key, err := GeneratePrivateKey(algorithm)
+		if err != nil {
+			t.Errorf("%q: %v", algorithm, err)
+			continue
+		}
+		if key.D == nil || !key.Curve.IsOnCurve(key.X, key.Y) {
+			t.Errorf("%q: invalid key generated", algorithm)
+		}
+	}
+	for _, algorithm := range []string{
+		"",
+		"ecdsa-sha2",
+		"(ecdsa-sha2 (curve p512))",
+		"(ecdsa-sha2 (curve p256) extra)",
+		"(ecdsa-sha2 (curve p256)) (extra)",
+		"(rsa-pkcs1-sha256 (curve p256))",
+	} {
+		if _, err := GeneratePrivateKey(algorithm); err == nil {
+			t.Errorf("%q: accepted", algorithm)
+		}
+	}
+}
+
+func TestPrivateKey_Zeroize(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.D.Sign() == 0 {
+		t.Fatal("Generated key has a zero scalar")
+	}
+	publicKey := key.PublicKey()
+	x := new(big.Int).Set(key.X)
+	words := key.D.Bits()
+	key.Zeroize()
+	if key.D.Sign() != 0 || key.X.Sign() != 0 || key.Y.Sign() != 0 {
+		t.Fatal("Key not zeroised")
+	}
+	for _, word := range words {
+		if word != 0 {
+			t.Fatal("Secret scalar left in memory")
+		}
+	}
+	if publicKey.Pk.X.Cmp(x) != 0 {
+		t.Fatal("Zeroising a private key altered its public key")
+	}
+}
+
+func TestEvalValid(t *testing.T) {
+	notBefore := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	for _, test := range []struct {
+		sexp  string
+		valid Valid
+	}{
+		{"(valid (not-before \"2014-01-01_00:00:00\") (not-after \"2014-12-31_23:59:00\"))", Valid{NotBefore: &notBefore, NotAfter: &notAfter}},
+		{"(valid (not-before \"2014-01-01_00:00:00\"))", Valid{NotBefore: &notBefore}},
+		{"(valid (not-after \"2014-12-31_23:59:00\"))", Valid{NotAfter: &notAfter}},
+		{"(valid)", Valid{}},
+	} {
+		sexp, _, err := sexprs.Parse([]byte(test.sexp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := EvalValid(sexp)
+		if err != nil {
+			t.Errorf("%s: %v", test.sexp, err)
+			continue
+		}
+		if !validEqual(&v, &test.valid) {
+			t.Errorf("%s: got %v", test.sexp, v)
+		}
+		if v.Sexp() != nil && !v.Sexp().Equal(sexp) {
+			t.Errorf("%s did not survive a round-trip: %s", test.sexp, v)
+		}
+	}
+	for _, bad := range []string{
+		"(valid (not-before \"2014-13-01_00:00:00\"))",
+		"(valid (not-before yesterday))",
+		"(valid (not-before \"2014-01-01_00:00:00\") (not-before \"2014-01-01_00:00:00\"))",
+		"(valid (not-during \"2014-01-01_00:00:00\"))",
+		"(valid not-before)",
+		"(invalid)",
+	} {
+		sexp, _, err := sexprs.Parse([]byte(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = EvalValid(sexp); err == nil {
+			t.Errorf("%s: accepted", bad)
+		}
+	}
+}
+
+func TestValid_Contains(t *testing.T) {
+	notBefore := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	v := Valid{NotBefore: &notBefore, NotAfter: &notAfter}
+	for _, test := range []struct {
+		t        time.Time
+		contains bool
+	}{
+		{notBefore.Add(-time.Nanosecond), false},
+		{notBefore, true},
+		{notBefore.Add(time.Hour), true},
+		{notAfter, true},
+		{notAfter.Add(time.Nanosecond), false},
+	} {
+		if v.Contains(test.t) != test.contains {
+			t.Errorf("Expected Contains(%v) to be %v", test.t, test.contains)
+		}
+	}
+	if !(Valid{}).Contains(notBefore) {
+		t.Error("Unbounded validity does not contain", notBefore)
+	}
+	if !(Valid{NotBefore: &notBefore}).Contains(notAfter.AddDate(100, 0, 0)) {
+		t.Error("Validity without NotAfter does not contain the far future")
+	}
+}
+
+func TestEvalHash_Length(t *testing.T) {
+	for algorithm, size := range map[string]int{"sha224": 28, "sha256": 32, "sha384": 48, "sha512": 64} {
+		h := Hash{Algorithm: algorithm, Hash: make([]byte, size)}
+		if _, err := EvalHash(h.Sexp()); err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+		h.Hash = h.Hash[:size-1]
+		if _, err := EvalHash(h.Sexp()); err == nil {
+			t.Errorf("%s: truncated hash accepted", algorithm)
+		}
+		h.Hash = make([]byte, size+1)
+		if _, err := EvalHash(h.Sexp()); err == nil {
+			t.Errorf("%s: over-long hash accepted", algorithm)
+		}
+	}
+}
+
+func TestSHA3(t *testing.T) {
+	for algorithm, digest := range map[string]string{
+		"sha3-256": "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532",
+		"sha3-384": "ec01498288516fc926459f58e2c6ad8df9b473cb0fc08c2596da7cf0e49be4b298d88cea927ac7f539f1edf228376d25",
+		"sha3-512": "b751850b1a57168a5693cd924b6b096e08f621827444f70d884f5d0240d2712e10e116e9192af3c91a7ec57647e3934057340b4cf408d5a56592f8274eec53f0",
+	} {
+		h, err := HashObject(algorithm, []byte("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(h.Hash) != digest {
+			t.Errorf("%s: expected %s; got %x", algorithm, digest, h.Hash)
+		}
+		h2, err := EvalHash(h.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Equal(h2) {
+			t.Errorf("%s hash did not survive a round-trip", algorithm)
+		}
+	}
+}
+
+// xorHash is a toy 4-byte hash, for testing hash registration.
+type xorHash struct {
+	sum [4]byte
+	n   int
+}
+
+func (x *xorHash) Write(p []byte) (int, error) {
+	for _, b := range p {
+		x.sum[x.n%4] ^= b
+		x.n++
+	}
+	return len(p), nil
+}
+func (x *xorHash) Sum(b []byte) []byte { return append(b, x.sum[:]...) }
+func (x *xorHash) Reset()              { *x = xorHash{} }
+func (x *xorHash) Size() int           { return 4 }
+func (x *xorHash) BlockSize() int      { return 4 }
+
+func TestRegisterHash(t *testing.T) {
+	RegisterHash("xor32", func() hash.Hash { return new(xorHash) }, 4)
+	defer func() {
+		hashesMu.Lock()
+		delete(KnownHashes, "xor32")
+		delete(hashSizes, "xor32")
+		hashesMu.Unlock()
+	}()
+	if size, ok := HashSize("xor32"); !ok || size != 4 {
+		t.Fatal("Registered hash has wrong size", size)
+	}
+	h, err := HashObject("xor32", []byte("abcdefgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Hash, []byte{'a' ^ 'e', 'b' ^ 'f', 'c' ^ 'g', 'd' ^ 'h'}) {
+		t.Fatalf("Unexpected digest %x", h.Hash)
+	}
+	sexp, _, err := sexprs.Parse([]byte("(hash xor32 #0404040c#)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := EvalHash(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h2.Equal(h) || !h2.Sexp().Equal(sexp) {
+		t.Fatal("Registered hash did not survive a round-trip", h2)
+	}
+}
+
+func TestHash_VerifyObject(t *testing.T) {
+	data := []byte("This is a test; it is only a test")
+	h, err := HashObject("sha384", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.VerifyObject(data) {
+		t.Error("Hash does not verify its own object")
+	}
+	if h.VerifyObject(data[1:]) {
+		t.Error("Hash verifies a different object")
+	}
+	if (Hash{Algorithm: "md5", Hash: h.Hash}).VerifyObject(data) {
+		t.Error("Hash with unknown algorithm verifies")
+	}
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.VerifySexp(key.PublicKey().Sexp()) {
+		t.Error("Key hash does not verify key")
+	}
+	if h.VerifySexp(key.Sexp()) {
+		t.Error("Public key hash verifies private key")
+	}
+}
+
+func TestHashSexp(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := sha256.New()
+	hasher.Write(key.PublicKey().Pack())
+	h, err := HashSexp("sha256", key.PublicKey().Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Equal(Hash{"sha256", hasher.Sum(nil), nil}) {
+		t.Fatal("HashSexp differs from hashing by hand")
+	}
+	for _, k := range []Key{key, key.PublicKey()} {
+		h2, err := k.HashExp("sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Equal(h2) {
+			t.Errorf("HashSexp differs from %T.HashExp", k)
+		}
+	}
+	if _, err = HashSexp("md5", key.Sexp()); err == nil {
+		t.Fatal("HashSexp accepted an unknown algorithm")
+	}
+}
+
+func TestHashReader(t *testing.T) {
+	data := make([]byte, 8<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	h, err := HashReader("sha512", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := HashObject("sha512", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Equal(h2) {
+		t.Fatal("HashReader differs from HashObject")
+	}
+	readErr := errors.New("read failed")
+	if _, err = HashReader("sha512", iotest.ErrReader(readErr)); err != readErr {
+		t.Fatal("Expected read error; got", err)
+	}
+	if _, err = HashReader("md5", bytes.NewReader(data)); err == nil {
+		t.Fatal("HashReader accepted an unknown algorithm")
+	}
+}
+
+func TestPublicKey_PublicKey(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := key.PublicKey()
+	if publicKey.PublicKey() != publicKey {
+		t.Fatal("PublicKey.PublicKey is not the key itself")
+	}
+	var k Key = publicKey
+	if k.PublicKey() != publicKey {
+		t.Fatal("PublicKey.PublicKey is not the key itself via Key")
+	}
+}
+
+func TestSubject(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []Subject{key, key.PublicKey(), HashKey{[]Hash{hash}}, hash} {
+		if s := subject.Subject(); s == nil || !s.Equal(hash.Sexp()) {
+			t.Errorf("%T: expected subject %v; got %v", subject, hash.Sexp(), s)
+		}
+	}
+	if (HashKey{}).Subject() != nil {
+		t.Error("Empty HashKey has a subject")
+	}
+	unknown := &PrivateKey{}
+	unknown.Curve = elliptic.P224()
+	if unknown.Subject() != nil {
+		t.Error("Key on an unknown curve has a subject")
+	}
+}
+
+func TestAuthCert_Cert(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	var c Cert = &cert
+	if !c.Certificate().Equal(c.Sexp()) || c.String() != c.Sexp().String() {
+		t.Fatal("Cert methods disagree")
+	}
+	seq := Sequence{c}
+	if !seq.Sexp().(sexprs.List)[1].Equal(cert.Sexp()) {
+		t.Fatal("Cert not usable as a SequenceElement")
+	}
+}
+
+var intersectTagsTests = []struct {
+	a, b, result string // result is empty if a & b do not overlap
+}{
+	{"(dns com.example.)", "(dns com.example.)", "(dns com.example.)"},
+	{"(dns com.example.)", "(dns org.example.)", ""},
+	{"(*)", "(dns com.example.)", "(dns com.example.)"},
+	{"(tag (*))", "(tag (dns com.example.))", "(tag (dns com.example.))"},
+	{"(dns (* prefix com.))", "(dns (* prefix com.example.))", "(dns (* prefix com.example.))"},
+	{"(dns (* prefix com.example.))", "(dns (* prefix com.))", "(dns (* prefix com.example.))"},
+	{"(dns (* prefix com.))", "(dns (* prefix org.))", ""},
+	{"(dns (* prefix com.))", "(dns com.example.)", "(dns com.example.)"},
+	{"(dns (* set com.example. org.example.))", "(dns org.example.)", "(dns org.example.)"},
+	{"(dns (* set com.example. org.example.))", "(dns net.example.)", ""},
+	{"(* set (dns com.example.) (ftp com.example.))", "(dns (* prefix com.))", "(dns com.example.)"},
+	{"(port (* range numeric ge 1024 l 65536))", "(port 8080)", "(port 8080)"},
+	{"(port (* range numeric ge 1024 l 65536))", "(port 80)", ""},
+	{"(ftp host)", "(ftp host read)", "(ftp host read)"},
+	{"(ftp host write)", "(ftp host read)", ""},
+	{"(ftp host)", "ftp", ""},
+	{"(file (*))", "(file null)", "(file null)"},
+	{"(file null)", "(file null)", "(file null)"},
+	{"(file (* set))", "(file a)", ""},
+	{"(port (* range numeric ge 0 le 100))", "(port (* range numeric ge 10 le 20))", "(port (* range numeric ge 10 le 20))"},
+	{"(port (* range numeric ge 10 le 20))", "(port (* range numeric le 100 ge 0))", "(port (* range numeric ge 10 le 20))"},
+	{"(port (* range numeric ge 0 l 100))", "(port (* range numeric g 50))", "(port (* range numeric g 50 l 100))"},
+	{"(port (* range numeric ge 5))", "(port (* range numeric g 5))", "(port (* range numeric g 5))"},
+	{"(port (* range numeric ge 0 le 10))", "(port (* range numeric ge 10))", "(port (* range numeric ge 10 le 10))"},
+	{"(port (* range numeric ge 0 le 10))", "(port (* range numeric g 10))", ""},
+	{"(port (* range numeric ge 0 le 10))", "(port (* range numeric ge 20))", ""},
+}
+
+func TestIntersectTags(t *testing.T) {
+	for _, test := range intersectTagsTests {
+		a, _, err := sexprs.Parse([]byte(test.a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _, err := sexprs.Parse([]byte(test.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := IntersectTags(a, b)
+		if err != nil {
+			t.Error(test.a, test.b, err)
+			continue
+		}
+		if test.result == "" {
+			if result != nil {
+				t.Errorf("Intersection of %s & %s was %s, not empty", test.a, test.b, result)
+			}
+			continue
+		}
+		expected, _, err := sexprs.Parse([]byte(test.result))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == nil || !result.Equal(expected) {
+			t.Errorf("Intersection of %s & %s was %s, not %s", test.a, test.b, result, test.result)
+		}
+	}
+}
+
+func TestIntersectTags_Errors(t *testing.T) {
+	for _, test := range []string{
+		"(dns (* prefix))",
+		"(dns (* bogus com.))",
+		"(dns (* range sideways ge a))",
+	} {
+		a, _, err := sexprs.Parse([]byte(test))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _, err := sexprs.Parse([]byte("(dns com.example.)"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := IntersectTags(a, b); err == nil {
+			t.Error("Expected an error intersecting", test)
+		}
+	}
+	// ranges of differing orderings cannot be intersected
+	a, _, err := sexprs.Parse([]byte("(port (* range numeric ge 1))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := sexprs.Parse([]byte("(port (* range alpha ge a))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IntersectTags(a, b); err == nil {
+		t.Error("Expected an error intersecting", a, "&", b)
+	}
+}
+
+func TestTagContains(t *testing.T) {
+	for _, test := range []struct {
+		authorized, requested string
+		contains              bool
+	}{
+		{"(*)", "(dns com.example.www.)", true},
+		{"(dns (* prefix com.example.))", "(dns com.example.www.)", true},
+		{"(dns (* prefix com.example.))", "(dns org.example.www.)", false},
+		{"(dns (* prefix com.example.))", "(dns (* prefix com.example.www.))", true},
+		{"(dns (* prefix com.example.www.))", "(dns (* prefix com.example.))", false},
+		{"(http (* set get put))", "(http get)", true},
+		{"(http (* set get put))", "(http (* set put get))", true},
+		{"(http (* set get put))", "(http delete)", false},
+		{"(http get)", "(http (* set get put))", false},
+		{"(port (* range numeric ge 1024 l 65536))", "(port 8080)", true},
+		{"(port (* range numeric ge 1024 l 65536))", "(port 80)", false},
+		{"(ftp ftp.example.com)", "(ftp ftp.example.com)", true},
+		{"(ftp ftp.example.com)", "(ftp ftp.example.com readonly)", true},
+		{"(ftp ftp.example.com readonly)", "(ftp ftp.example.com)", false},
+		{"(tag (ftp ftp.example.com))", "(ftp ftp.example.com)", true},
+		{"(dns (* prefix))", "(dns com.example.)", false},
+		{"(file (*))", "(file null)", true},
+		{"(file null)", "(file null)", true},
+		{"(file null)", "(file other)", false},
+		{"(port (* range numeric ge 0 le 100))", "(port (* range numeric ge 10 le 20))", true},
+		{"(port (* range numeric ge 10 le 20))", "(port (* range numeric ge 0 le 100))", false},
+	} {
+		authorized, _, err := sexprs.Parse([]byte(test.authorized))
+		if err != nil {
+			t.Fatal(err)
+		}
+		requested, _, err := sexprs.Parse([]byte(test.requested))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if TagContains(authorized, requested) != test.contains {
+			t.Errorf("TagContains(%s, %s) should be %v", test.authorized, test.requested, test.contains)
+		}
+	}
+}
+
+func TestReduce(t *testing.T) {
+	var keys []*PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	cert1 := testCert(t, keys[0], keys[1].PublicKey(), "(dns (* prefix com.))")
+	hash, err := keys[2].PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert2 := keys[1].IssueAuthCert(hash, sexprs.List{sexprs.Atom{Value: []byte("dns")}, sexprs.Atom{Value: []byte("com.example.")}}, Valid{})
+	cert2.Delegate = false
+	result, err := Reduce([]*AuthCert{&cert1, &cert2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTag, _, err := sexprs.Parse([]byte("(dns com.example.)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case !result.Issuer.Equal(cert1.Issuer):
+		t.Error("Reduced certificate has the wrong issuer", result.Issuer)
+	case !sexpEqual(subjectSexp(result.Subject), hash.Sexp()):
+		t.Error("Reduced certificate has the wrong subject", result.Subject)
+	case result.Delegate:
+		t.Error("Reduced certificate should not be delegable")
+	case !result.Tag.Equal(expectedTag):
+		t.Error("Reduced certificate has the wrong tag", result.Tag)
+	case !validEqual(result.Valid, cert1.Valid):
+		t.Error("Reduced certificate has the wrong validity", result.Valid)
+	}
+
+	// cert2 may not be delegated
+	cert3 := testCert(t, keys[2], keys[0].PublicKey(), "(dns com.example.)")
+	if _, err := Reduce([]*AuthCert{&cert1, &cert2, &cert3}); err == nil {
+		t.Error("Expected an error reducing through a non-delegable certificate")
+	}
+	// keys[0] is not the subject of cert1
+	if _, err := Reduce([]*AuthCert{&cert1, &cert1}); err == nil {
+		t.Error("Expected an error reducing a broken chain")
+	}
+	disjoint := testCert(t, keys[1], keys[2].PublicKey(), "(dns org.example.)")
+	if _, err := Reduce([]*AuthCert{&cert1, &disjoint}); err == nil {
+		t.Error("Expected an error reducing disjoint tags")
+	}
+	if _, err := Reduce(nil); err == nil {
+		t.Error("Expected an error reducing an empty chain")
+	}
+}
+
+func TestPrivateKey_HashAlgorithm(t *testing.T) {
+	for curve, algorithm := range map[string]string{"p256": "sha256", "p384": "sha384"} {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve " + curve + "))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.HashAlgorithm() != algorithm || key.PublicKey().HashAlgorithm() != algorithm {
+			t.Errorf("Expected %s for %s; got %s & %s", algorithm, curve, key.HashAlgorithm(), key.PublicKey().HashAlgorithm())
+		}
+	}
+}
+
+func TestPublicKey_HashAlgorithm(t *testing.T) {
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	for curve, algorithm := range map[string]string{"p256": "sha256", "p384": "sha384"} {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve " + curve + "))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := key.PublicKey()
+		if pub.HashAlgorithm() != algorithm {
+			t.Errorf("Expected %s for %s; got %s", algorithm, curve, pub.HashAlgorithm())
+		}
+		if _, ok := KnownHashes[pub.HashAlgorithm()]; !ok {
+			t.Errorf("%s is not a hash algorithm", pub.HashAlgorithm())
+		}
+		sig, err := key.Sign(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.Hash.Algorithm != pub.HashAlgorithm() {
+			t.Errorf("%s key signs with %s, not %s", curve, sig.Hash.Algorithm, pub.HashAlgorithm())
+		}
+	}
+	sk, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm := (&PublicKey{Pk: sk.PublicKey}).HashAlgorithm(); algorithm != "" {
+		t.Error("Expected no hash algorithm for P-521; got", algorithm)
+	}
+}
+
+func TestPrivateKey_Signer(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := key.Signer()
+	pub, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(&key.PublicKey().Pk) {
+		t.Fatal("Signer's public key is not the key's", signer.Public())
+	}
+	digest := sha256.Sum256([]byte("interop"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Error("Signer's signature does not verify")
+	}
+}
+
+func TestPublicKeyFromECDSA(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		sk, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := PublicKeyFromECDSA(&sk.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pub.ECDSA().Equal(&sk.PublicKey) {
+			t.Error("Public key did not round-trip on", curve.Params().Name)
+		}
+		priv, err := PrivateKeyFromECDSA(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if priv.D.Cmp(sk.D) != 0 || !priv.PublicKey().ECDSA().Equal(&sk.PublicKey) {
+			t.Error("Private key did not round-trip on", curve.Params().Name)
+		}
+		priv.Zeroize()
+		if sk.D.Sign() == 0 {
+			t.Error("Zeroising the converted key zeroised the original")
+		}
+	}
+	sk, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublicKeyFromECDSA(&sk.PublicKey); err == nil {
+		t.Error("Expected an error converting a P224 public key")
+	}
+	if _, err := PrivateKeyFromECDSA(sk); err == nil {
+		t.Error("Expected an error converting a P224 private key")
+	}
+}
+
+func TestParsePEM(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := key.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ParsePEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, ok := k.(*PrivateKey)
+	if !ok || priv.D.Cmp(key.D) != 0 || !priv.PublicKey().ECDSA().Equal(key.PublicKey().ECDSA()) {
+		t.Error("Private key did not round-trip through PEM", k)
+	}
+	data, err = key.PublicKey().MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(PublicKeyPEMType)) {
+		t.Error("Public key PEM has the wrong type", string(data))
+	}
+	k, err = ParsePEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := k.(*PublicKey)
+	if !ok || !pub.ECDSA().Equal(key.PublicKey().ECDSA()) {
+		t.Error("Public key did not round-trip through PEM", k)
+	}
+	if _, err := ParsePEM([]byte("not PEM")); err == nil {
+		t.Error("Expected an error parsing non-PEM data")
+	}
+}
+
+func TestPublicKeyFromPKIX(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &sk.PublicKey, sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := PublicKeyFromPKIX(cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.ECDSA().Equal(&sk.PublicKey) {
+		t.Error("Key taken from certificate is not the certified key")
+	}
+	der, err = k.MarshalPKIX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der, cert.RawSubjectPublicKeyInfo) {
+		t.Error("Key did not round-trip through PKIX")
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublicKeyFromPKIX(der); err == nil {
+		t.Error("Expected an error importing an Ed25519 key")
+	}
+}
+
+func TestPublicKey_Fingerprint(t *testing.T) {
+	for _, test := range []struct{ curve, algorithm string }{{"p256", "sha256"}, {"p384", "sha384"}} {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve " + test.curve + "))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := key.PublicKey().HashExp(test.algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprint, err := key.PublicKey().Fingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fingerprint.Equal(expected) {
+			t.Error("Public key fingerprint is wrong on", test.curve, fingerprint)
+		}
+		fingerprint, err = key.Fingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fingerprint.Equal(expected) {
+			t.Error("Private key fingerprint is wrong on", test.curve, fingerprint)
+		}
+		if !fingerprint.Sexp().Equal(key.Subject()) {
+			t.Error("Private key fingerprint is not its subject on", test.curve, fingerprint)
+		}
+	}
+	// a key's fingerprint is the hash in its subject, hint or no
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hinted := key.PublicKey()
+	hinted.PreferredHash = "sha512"
+	fingerprint, err := hinted.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint.Algorithm != "sha512" || !fingerprint.Sexp().Equal(hinted.Subject()) {
+		t.Errorf("Expected the fingerprint %s; got %s", hinted.Subject(), fingerprint)
+	}
+	if !(HashKey{[]Hash{fingerprint}}).Equal(key) {
+		t.Error("Hinted fingerprint does not identify the key")
+	}
+}
+
+func TestKey_Equal(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := EvalPublicKey(key.PublicKey().Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashKey := HashKey{[]Hash{hash}}
+	for _, test := range []struct {
+		a, b  Key
+		equal bool
+	}{
+		{key, key, true},
+		{key, key.PublicKey(), true},
+		{key.PublicKey(), key, true},
+		{key.PublicKey(), parsed, true},
+		{key.PublicKey(), hashKey, true},
+		{hashKey, key.PublicKey(), true},
+		{key, hashKey, true},
+		{hashKey, key, true},
+		{key, other, false},
+		{key.PublicKey(), other.PublicKey(), false},
+		{other.PublicKey(), hashKey, false},
+		{hashKey, other, false},
+		{key.PublicKey(), nil, false},
+	} {
+		if test.a.Equal(test.b) != test.equal {
+			t.Errorf("%v.Equal(%v) should be %v", test.a, test.b, test.equal)
+		}
+	}
+	clone := privateKeyFromScalar(key.Curve, new(big.Int).Add(key.D, big.NewInt(1)))
+	clone.X, clone.Y = key.X, key.Y
+	if key.Equal(clone) {
+		t.Error("Private keys with different scalars should not be equal")
+	}
+}
+
+func BenchmarkPublicKey_Equal(b *testing.B) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	parsed, err := EvalPublicKey(key.PublicKey().Sexp())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key.PublicKey().Equal(parsed)
+	}
+}
+
+// BenchmarkHashKey_Equal measures the hashing comparison which
+// BenchmarkPublicKey_Equal avoids.
+func BenchmarkHashKey_Equal(b *testing.B) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		b.Fatal(err)
+	}
+	hashKey := HashKey{[]Hash{hash}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hashKey.Equal(key.PublicKey())
+	}
+}
+
+func TestRSAPrivateKey(t *testing.T) {
+	key, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.SignatureAlgorithm() != "rsa-pkcs1-sha256" {
+		t.Error("Wrong signature algorithm", key.SignatureAlgorithm())
+	}
+	pub, err := EvalRSAPublicKey(key.RSAPublicKey().Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(key) || !key.Equal(pub) {
+		t.Error("RSA public key did not round-trip", pub)
+	}
+	priv, err := EvalRSAPrivateKey(key.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priv.Equal(key) {
+		t.Error("RSA private key did not round-trip", priv)
+	}
+	hash, err := pub.HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(HashKey{[]Hash{hash}}).Equal(key) {
+		t.Error("RSA key is not equal to its hash")
+	}
+	// an RSA key has no ECDSA public key, but is not a hash either
+	for _, k := range []Key{pub, key} {
+		if k.PublicKey() != nil || k.IsHash() {
+			t.Errorf("Expected %T to be a key without an ECDSA public key", k)
+		}
+	}
+	s := sexprs.List{sexprs.Atom{Value: []byte("test")}}
+	sig, err := key.Sign(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.Verify(s); err != nil {
+		t.Error(err)
+	}
+	if err := sig.Verify(sexprs.List{sexprs.Atom{Value: []byte("other")}}); err == nil {
+		t.Error("RSA signature verified the wrong object")
+	}
+	sig.Value[0] ^= 0xff
+	if err := sig.Verify(s); err == nil {
+		t.Error("Corrupt RSA signature verified")
+	}
+}
+
+func TestRSASignature_RoundTrip(t *testing.T) {
+	rsaKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, _, err := sexprs.Parse([]byte("(dns (* prefix com.example.))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	cert := AuthCert{
+		Issuer:  Name{Principal: rsaKey.RSAPublicKey()},
+		Subject: key.PublicKey(),
+		Tag:     tag,
+		Valid:   &Valid{NotBefore: &notBefore, NotAfter: &notAfter},
+	}
+	sig, err := rsaKey.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Eval(sig.Sexp(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, ok := v.(*RSASignature)
+	if !ok {
+		t.Fatalf("Expected an *RSASignature; got %T", v)
+	}
+	if err := sig2.Verify(cert.Sexp()); err != nil {
+		t.Error(err)
+	}
+	s, _, err := sexprs.Parse(Sequence{cert, sig}.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := EvalSequence(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seq.Verify(); err != nil {
+		t.Error(err)
+	}
+	if signers := seq.Coverage()[0]; len(signers) != 1 || !signers[0].Equal(rsaKey) {
+		t.Error("RSA signature does not cover the certificate", signers)
+	}
+	request, _, _ := sexprs.Parse([]byte("(dns com.example.www.)"))
+	at := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	if ok, err := Authorize(seq, rsaKey.RSAPublicKey(), key.PublicKey(), request, at); !ok {
+		t.Error("RSA-signed certificate did not authorise its subject", err)
+	}
+}
+
+// Test vectors from RFC 6979, appendices A.2.5 & A.2.6, for the
+// message "sample".
+var deterministicTests = []struct {
+	curve, algorithm, r, s string
+}{
+	{"p256", "sha256",
+		"EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716",
+		"F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+	{"p384", "sha384",
+		"94EDBB92A5ECB8AAD4736E56C691916B3F88140666CE9FA73D64C4EA95AD133C81A648152E44ACF96E36DD1E80FABE46",
+		"99EF4AEB15F178CEA1FE40DB2603138F130E740A19624526203B6351D0A3A94FA329C145786E679E7B82C71A38628AC8"},
+}
+
+func TestPrivateKey_SignDeterministic(t *testing.T) {
+	for i, test := range deterministicTests {
+		key, err := PrivateKeyFromScalar(test.curve, mustDecodeHex(t, scalarTests[i].d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := HashObject(test.algorithm, []byte("sample"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := key.signDeterministic(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := new(big.Int).SetBytes(mustDecodeHex(t, test.r))
+		s := new(big.Int).SetBytes(mustDecodeHex(t, test.s))
+		if sig.R.Cmp(r) != 0 || sig.S.Cmp(s) != 0 {
+			t.Errorf("%s: expected (%x, %x); got (%x, %x)", test.curve, r, s, sig.R, sig.S)
+		}
+
+		message := sexprs.List{sexprs.Atom{Value: []byte("sample")}}
+		sig1, err := key.SignDeterministic(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig2, err := key.SignDeterministic(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig1.R.Cmp(sig2.R) != 0 || sig1.S.Cmp(sig2.S) != 0 {
+			t.Error("Deterministic signatures differ")
+		}
+		if err := sig1.Verify(message); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSignature_Equal(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(key.PublicKey().Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := EvalSignature(sig.Sexp(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sig.Equal(parsed) || !parsed.Equal(sig) {
+		t.Error("Parsed signature is not equal to the original")
+	}
+	differentR := *sig
+	differentR.R = new(big.Int).Add(sig.R, big.NewInt(1))
+	if sig.Equal(&differentR) {
+		t.Error("Signatures with different R values are equal")
+	}
+	differentPrincipal := *sig
+	differentPrincipal.Principal = other.PublicKey()
+	if sig.Equal(&differentPrincipal) {
+		t.Error("Signatures by different principals are equal")
+	}
+	var nilSig *Signature
+	if sig.Equal(nil) || nilSig.Equal(sig) || !nilSig.Equal(nil) {
+		t.Error("nil signatures are mishandled")
+	}
+}
+
+func TestValid_NowValid(t *testing.T) {
+	defer func() { Now = time.Now }()
+	notBefore := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	v := Valid{NotBefore: &notBefore, NotAfter: &notAfter}
+	for _, test := range []struct {
+		now   time.Time
+		valid bool
+	}{
+		{notBefore.Add(-time.Second), false},
+		{notBefore, true},
+		{time.Date(2014, time.June, 1, 12, 0, 0, 0, time.UTC), true},
+		{notAfter, true},
+		{notAfter.Add(time.Second), false},
+	} {
+		now := test.now
+		Now = func() time.Time { return now }
+		if v.NowValid() != test.valid {
+			t.Errorf("NowValid at %s should be %v", now, test.valid)
+		}
+	}
+	if !(Valid{}).NowValid() {
+		t.Error("Unbounded validity should always be valid")
+	}
+}
+
+func TestEvalValid_Online(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "(valid (not-after \"2014-12-31_23:59:00\") (online crl (uris \"http://example.com/crl\") " + hash.String() + " (id crl1) (cert serial)) (online new-cert (uris \"http://example.com/new\")))"
+	s, _, err := sexprs.Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := EvalValid(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.RequiresOnlineCheck() || len(v.Online) != 2 {
+		t.Fatal("Expected two online tests; got", v.Online)
+	}
+	crl := v.Online[0]
+	if crl.Type != "crl" || string(crl.ID) != "crl1" || len(crl.Parts) != 1 || !crl.Principal.Equal(key) || crl.URIs[0].String() != "http://example.com/crl" {
+		t.Error("CRL test parsed incorrectly", crl)
+	}
+	if v.Online[1].Type != "new-cert" || v.Online[1].Principal != nil {
+		t.Error("New-cert test parsed incorrectly", v.Online[1])
+	}
+	if !v.Sexp().Equal(s) {
+		t.Error("Online validity did not round-trip", v.Sexp())
+	}
+	var checked []string
+	ok, err := v.CheckOnline(func(t OnlineTest) (bool, error) {
+		checked = append(checked, t.Type)
+		return t.Type == "crl", nil
+	})
+	if ok || err != nil || len(checked) != 2 {
+		t.Error("CheckOnline should fail the new-cert test", ok, err, checked)
+	}
+	if (Valid{}).RequiresOnlineCheck() {
+		t.Error("Validity without online tests requires an online check")
+	}
+	_, i := v.Intersect(Valid{})
+	if len(i.Online) != 2 {
+		t.Error("Intersection lost online tests", i)
+	}
+}
+
+func TestValid_IsOneTime(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "(valid (online one-time (uris \"http://example.com/check\") " + key.PublicKey().String() + " (id check)))"
+	s, _, err := sexprs.Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := EvalValid(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.IsOneTime() {
+		t.Fatal("Expected a one-time validity")
+	}
+	if !v.Sexp().Equal(s) {
+		t.Error("One-time validity did not round-trip", v.Sexp())
+	}
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	ok, i := (Valid{NotAfter: &notAfter}).Intersect(v)
+	if !ok || !i.IsOneTime() {
+		t.Error("One-time test did not survive intersection", i)
+	}
+
+	cert1 := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	cert2 := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	cert2.Valid = &v
+	if !cert1.Cacheable() || cert2.Cacheable() {
+		t.Error("Only the one-time certificate should be uncacheable")
+	}
+	result, err := Reduce([]*AuthCert{&cert1, &cert2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Cacheable() {
+		t.Error("Reduction of a one-time certificate should not be cacheable")
+	}
+	cache := NewCertCache(2)
+	cache.Put(Sequence{cert2}, result)
+	if cache.Len() != 0 {
+		t.Error("Cached the result for a one-time certificate")
+	}
+}
+
+func TestValid_SexpISO(t *testing.T) {
+	notBefore := time.Date(2014, time.January, 1, 0, 0, 17, 0, time.UTC)
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 59, 0, time.UTC)
+	v := Valid{NotBefore: &notBefore, NotAfter: &notAfter}
+	for _, s := range []sexprs.Sexp{v.Sexp(), v.SexpISO()} {
+		parsed, err := EvalValid(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !validEqual(&parsed, &v) {
+			t.Errorf("%s did not round-trip; got %v", s, parsed.Sexp())
+		}
+	}
+	expected := "(5:valid(10:not-before20:2014-01-01T00:00:17Z)(9:not-after20:2014-12-31T23:59:59Z))"
+	if string(Canonicalize(v.SexpISO())) != expected {
+		t.Errorf("Expected %s; got %s", expected, Canonicalize(v.SexpISO()))
+	}
+	s, _, err := sexprs.Parse([]byte("(valid (not-after \"2014-12-31T18:59:59-05:00\"))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := EvalValid(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.NotAfter.Equal(notAfter) || parsed.NotAfter.Location() != time.UTC {
+		t.Error("ISO 8601 date with an offset was not converted to UTC", parsed.NotAfter)
+	}
+}
+
+func TestValid_SexpSeconds(t *testing.T) {
+	notBefore := time.Date(2014, time.March, 4, 5, 6, 7, 0, time.UTC)
+	v := Valid{NotBefore: &notBefore}
+	if string(Canonicalize(v.Sexp())) != "(5:valid(10:not-before19:2014-03-04_05:06:07))" {
+		t.Error("Seconds were not serialised", v.Sexp())
+	}
+	parsed, err := EvalValid(v.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.NotBefore.Equal(notBefore) {
+		t.Errorf("Expected %v; got %v", notBefore, parsed.NotBefore)
+	}
+}
+
+func TestName_Resolve(t *testing.T) {
+	var keys []Key
+	for i := 0; i < 3; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key.PublicKey())
+	}
+	alice, bob, carol := keys[0], keys[1], keys[2]
+	// an in-memory store of name certificates
+	store := map[string][]*Name{}
+	bind := func(issuer Key, name string, subject *Name) {
+		local := (&Name{issuer, []string{name}}).String()
+		store[local] = append(store[local], subject)
+	}
+	bind(alice, "friend", &Name{Principal: bob})
+	bind(bob, "colleague", &Name{Principal: carol})
+	bind(bob, "colleague", &Name{alice, []string{"friend"}})
+	bind(carol, "self", &Name{carol, []string{"self"}})
+	bind(carol, "grow", &Name{carol, []string{"grow", "grow"}})
+	lookup := func(n *Name) []*Name {
+		return store[n.String()]
+	}
+
+	principals, err := (&Name{alice, []string{"friend", "colleague"}}).Resolve(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(principals) != 2 || !principals[0].Principal.Equal(carol) || !principals[1].Principal.Equal(bob) {
+		t.Error("Expected carol & bob; got", principals)
+	}
+	principals, err = (&Name{carol, []string{"self"}}).Resolve(lookup)
+	if err != nil || len(principals) != 0 {
+		t.Error("Expected a cyclic name to resolve to nothing; got", principals, err)
+	}
+	principals, err = (&Name{Principal: alice}).Resolve(lookup)
+	if err != nil || len(principals) != 1 || !principals[0].Principal.Equal(alice) {
+		t.Error("A principal should resolve to itself; got", principals, err)
+	}
+	if _, err := (&Name{Names: []string{"friend"}}).Resolve(lookup); err == nil {
+		t.Error("Expected an error resolving a name relative to Self")
+	}
+	if _, err := (&Name{carol, []string{"grow"}}).Resolve(lookup); err == nil {
+		t.Error("Expected an error resolving an ever-growing name")
+	}
+}
+
+// Names which share sub-names, here a wide diamond of 2^30 paths,
+// resolve each sub-name once.
+func TestName_ResolveDiamond(t *testing.T) {
+	var keys []Key
+	for i := 0; i < 2; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key.PublicKey())
+	}
+	alice, bob := keys[0], keys[1]
+	const levels = 30
+	store := map[string][]*Name{}
+	for i := 0; i < levels; i++ {
+		next := []*Name{{alice, []string{fmt.Sprint("a", i+1)}}, {alice, []string{fmt.Sprint("b", i+1)}}}
+		if i == levels-1 {
+			next = []*Name{{Principal: bob}}
+		}
+		for _, name := range []string{"a", "b"} {
+			store[(&Name{alice, []string{fmt.Sprint(name, i)}}).String()] = next
+		}
+	}
+	lookups := 0
+	lookup := func(n *Name) []*Name {
+		lookups++
+		return store[n.String()]
+	}
+	principals, err := (&Name{alice, []string{"a0"}}).Resolve(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(principals) != 1 || !principals[0].Principal.Equal(bob) {
+		t.Error("Expected bob; got", principals)
+	}
+	if lookups > 2*levels {
+		t.Errorf("Expected at most %d lookups; got %d", 2*levels, lookups)
+	}
+}
+
+func TestEvalNameCert(t *testing.T) {
+	alice, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bob.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Date(2014, time.December, 31, 23, 59, 0, 0, time.UTC)
+	issuer := Name{alice.PublicKey(), []string{"friend"}}
+	for _, subject := range []Subject{bob.PublicKey(), hash, &Name{bob.PublicKey(), []string{"colleague"}}} {
+		cert := NameCert{Issuer: issuer, Subject: subject, Valid: &Valid{NotAfter: &notAfter}}
+		parsed, err := EvalNameCert(cert.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Sexp().Equal(cert.Sexp()) {
+			t.Errorf("Name certificate did not round-trip: expected %s; got %s", cert, parsed)
+		}
+	}
+	bad, _, err := sexprs.Parse([]byte("(cert (issuer (name friend)) (subject (name colleague)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EvalNameCert(bad); err == nil {
+		t.Error("Expected an error parsing a name certificate without an issuing principal")
+	}
+
+	certs := []NameCert{
+		{Issuer: issuer, Subject: &Name{bob.PublicKey(), []string{"colleague"}}},
+		{Issuer: Name{bob.PublicKey(), []string{"colleague"}}, Subject: hash},
+	}
+	principals, err := (&Name{alice.PublicKey(), []string{"friend"}}).Resolve(NameCertLookup(certs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(principals) != 1 || !principals[0].Principal.Equal(bob) {
+		t.Error("Expected bob; got", principals)
+	}
+
+	// a relative subject names something in its issuer's namespace
+	certs = nil
+	for _, text := range []string{
+		"(cert (issuer (name " + alice.PublicKey().String() + " friend)) (subject (name colleague)))",
+		"(cert (issuer (name " + alice.PublicKey().String() + " colleague)) (subject " + hash.String() + "))",
+	} {
+		s, _, err := sexprs.Parse([]byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := EvalNameCert(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	principals, err = (&Name{alice.PublicKey(), []string{"friend"}}).Resolve(NameCertLookup(certs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(principals) != 1 || !principals[0].Principal.Equal(bob) {
+		t.Error("Expected bob through a relative name; got", principals)
+	}
+	if subject := certs[0].Subject.(*Name); subject.Principal != nil {
+		t.Error("Resolving changed the certificate's subject to", subject)
+	}
+}
+
+func TestEvalNameCert_Expr(t *testing.T) {
+	alice, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bob.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the display hint is not kept by the parsed Name, so the
+	// certificate is signed & must verify as written
+	friend := sexprs.Atom{DisplayHint: []byte("text/plain"), Value: []byte("friend")}
+	s := sexprs.List{certAtom,
+		sexprs.List{issuerAtom, sexprs.List{nameAtom, alice.PublicKey().Sexp(), friend}},
+		sexprs.List{subjectAtom, hash.Sexp()}}
+	sig, err := alice.Sign(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := EvalNameCert(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Pack(), s.Pack()) {
+		t.Errorf("Name certificate did not re-serialise exactly: expected %s; got %s", s, cert)
+	}
+	packed, _, err := sexprs.Parse(sexprs.List{sequenceAtom, s, sig.Sexp()}.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := EvalSequence(packed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seq.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNameCert_KeySubject(t *testing.T) {
+	alice, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := NameCert{Issuer: Name{alice.PublicKey(), []string{"friend"}}, Subject: bob.PublicKey().AsSubject(true)}
+	sig, err := alice.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, err := sexprs.Parse(Sequence{cert, sig}.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := EvalSequence(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seq.Verify(); err != nil {
+		t.Error(err)
+	}
+	parsed, ok := seq[0].(NameCert)
+	if !ok {
+		t.Fatalf("Expected a NameCert; got %T", seq[0])
+	}
+	ks, ok := parsed.Subject.(KeySubject)
+	if !ok || !ks.Key.Equal(bob) {
+		t.Fatal("Expected a KeySubject for bob; got", parsed.Subject)
+	}
+	// rebuilt from its fields, the certificate is still the one signed
+	parsed.Expr = nil
+	if err := sig.Verify(parsed.Sexp()); err != nil {
+		t.Error(err)
+	}
+}
+
+// A full RSA key as a subject is written out in full again once parsed,
+// just as an ECDSA key is.
+func TestKeySubject_RSA(t *testing.T) {
+	alice, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := bob.RSAPublicKey().AsSubject(true)
+	nameCert := NameCert{Issuer: Name{alice.PublicKey(), []string{"friend"}}, Subject: subject}
+	parsedName, err := EvalNameCert(nameCert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, ok := parsedName.Subject.(KeySubject)
+	if !ok || !ks.Key.Equal(bob) {
+		t.Fatal("Expected a KeySubject for bob; got", parsedName.Subject)
+	}
+	parsedName.Expr = nil
+	if !bytes.Equal(parsedName.Sexp().Pack(), nameCert.Sexp().Pack()) {
+		t.Error("Rebuilt name certificate differs from the original", parsedName)
+	}
+
+	tag, _, err := sexprs.Parse([]byte("(ftp)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCert := alice.IssueAuthCert(subject, tag, Valid{})
+	parsedAuth, err := EvalAuthCert(authCert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := parsedAuth.SubjectKey(); !ok || !k.Equal(bob) {
+		t.Fatal("Expected bob as the subject key; got", parsedAuth.Subject)
+	}
+	parsedAuth.Expr = nil
+	if !bytes.Equal(parsedAuth.Sexp().Pack(), authCert.Sexp().Pack()) {
+		t.Error("Rebuilt auth certificate differs from the original", parsedAuth)
+	}
+}
+
+func TestName_EqualNilPrincipal(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := &Name{Names: []string{"a", "b"}}
+	if !self.Equal(Name{Names: []string{"a", "b"}}) {
+		t.Error("Equal names relative to Self are unequal")
+	}
+	if self.Equal(Name{Names: []string{"a"}}) {
+		t.Error("Different names relative to Self are equal")
+	}
+	if self.Equal(Name{key.PublicKey(), []string{"a", "b"}}) {
+		t.Error("A name relative to Self equals one relative to a key")
+	}
+	if (&Name{key.PublicKey(), []string{"a", "b"}}).Equal(*self) {
+		t.Error("A name relative to a key equals one relative to Self")
+	}
+}
+
+func TestName_IsPrefix(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := key.PublicKey()
+	for _, test := range []struct {
+		a, b   *Name
+		prefix bool
+	}{
+		{&Name{pk, []string{"a"}}, &Name{pk, []string{"a", "b"}}, true},
+		{&Name{pk, []string{"a", "b"}}, &Name{pk, []string{"a", "b"}}, true},
+		{&Name{pk, []string{"a", "b"}}, &Name{pk, []string{"a"}}, false},
+		{&Name{pk, []string{"b"}}, &Name{pk, []string{"a", "b"}}, false},
+		{&Name{Principal: pk}, &Name{pk, []string{"a"}}, true},
+		{&Name{Names: []string{"a"}}, &Name{Names: []string{"a", "b"}}, true},
+		{&Name{Names: []string{"a", "b"}}, &Name{Names: []string{"a"}}, false},
+		{&Name{Names: []string{"a"}}, &Name{pk, []string{"a", "b"}}, false},
+		{&Name{pk, []string{"a"}}, &Name{Names: []string{"a", "b"}}, false},
+		{&Name{pk, []string{"a"}}, nil, false},
+		{nil, nil, true},
+	} {
+		if test.a.IsPrefix(test.b) != test.prefix {
+			t.Errorf("%v.IsPrefix(%v) should be %v", test.a, test.b, test.prefix)
+		}
+	}
+}
+
+func TestName_Append(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := key.PublicKey()
+	// spare capacity, which a careless append would write into
+	names := make([]string, 1, 4)
+	names[0] = "a"
+	n := &Name{pk, names}
+	ab := n.Append("b")
+	ac := n.Append("c")
+	if !ab.Equal(Name{pk, []string{"a", "b"}}) {
+		t.Errorf("Expected (name KEY a b); got %s", ab)
+	}
+	if !ac.Equal(Name{pk, []string{"a", "c"}}) {
+		t.Errorf("Expected (name KEY a c); got %s", ac)
+	}
+	if !n.Equal(Name{pk, []string{"a"}}) {
+		t.Errorf("Append changed the original name to %s", n)
+	}
+	abc := (&Name{Principal: pk}).Extend("a", "b", "c")
+	if !abc.Equal(Name{pk, []string{"a", "b", "c"}}) {
+		t.Errorf("Expected (name KEY a b c); got %s", abc)
+	}
+	abc.Names[0] = "z"
+	if ab.Names[0] != "a" || n.Names[0] != "a" {
+		t.Error("Extended names share storage")
+	}
+	if self := (*Name)(nil).Append("a"); !self.Equal(Name{Names: []string{"a"}}) {
+		t.Errorf("Expected (name Self a); got %s", self)
+	}
+}
+
+func TestName_IsSelf(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := key.PublicKey()
+	self := &Name{}
+	if !self.IsSelf() || (&Name{Names: []string{"a"}}).IsSelf() || (&Name{Principal: pk}).IsSelf() || (*Name)(nil).IsSelf() {
+		t.Error("IsSelf should be true only of Self")
+	}
+	if self.String() != "Self" {
+		t.Errorf("Expected Self; got %s", self)
+	}
+	self2, err := EvalName(self.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !self2.IsSelf() || !self.Equal(*self2) {
+		t.Errorf("Expected Self; got %s", self2)
+	}
+	if self.Equal(Name{Names: []string{"a"}}) || self.Equal(Name{Principal: pk}) {
+		t.Error("Self should equal only Self")
+	}
+
+	cert := testCert(t, key, pk, "(dns com.example.)")
+	cert.Issuer = Name{}
+	cert2, err := EvalAuthCert(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert2.Issuer.IsSelf() || !cert.SemanticEqual(&cert2) {
+		t.Errorf("Expected %s; got %s", cert, cert2)
+	}
+	if resolved := cert2.Issuer.ResolveSelf(pk); !resolved.Equal(Name{Principal: pk}) {
+		t.Errorf("Expected %s; got %s", pk, resolved)
+	}
+}
+
+func TestSequence_Verify(t *testing.T) {
+	key1, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert1 := testCert(t, key1, key2.PublicKey(), "(dns (* prefix com.example.))")
+	cert2 := testCert(t, key2, key1.PublicKey(), "(dns (* prefix org.example.))")
+	sig1, err := key1.Sign(cert1.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := key2.Sign(cert2.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (Sequence{key1.PublicKey(), cert1, sig1, cert2, sig2}).Verify(); err != nil {
+		t.Error(err)
+	}
+	// a co-signature of the first certificate, further back
+	cosig, err := key2.Sign(cert1.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (Sequence{cert1, sig1, cert2, sig2, cosig}).Verify(); err != nil {
+		t.Error(err)
+	}
+	err = Sequence{sig1, cert2, sig1, sig2}.Verify()
+	seqErr, ok := err.(SequenceError)
+	if !ok {
+		t.Fatal("Expected a SequenceError; got", err)
+	}
+	if len(seqErr.Errors) != 2 || seqErr.Errors[0] == nil || seqErr.Errors[2] == nil {
+		t.Error("Expected elements 0 & 2 to fail; got", seqErr)
+	}
+}
+
+func TestUnsupportedCurveError(t *testing.T) {
+	var curveErr UnsupportedCurveError
+	for _, curve := range []string{"p521", "bogus"} {
+		_, err := GeneratePrivateKey("(ecdsa-sha2 (curve " + curve + "))")
+		if !errors.As(err, &curveErr) || curveErr.Curve != curve {
+			t.Errorf("Expected an UnsupportedCurveError for %s; got %v", curve, err)
+		}
+		if _, err := PrivateKeyFromScalar(curve, []byte{1}); !errors.As(err, &curveErr) {
+			t.Errorf("Expected an UnsupportedCurveError for %s; got %v", curve, err)
+		}
+		s, _, err := sexprs.Parse([]byte("(public-key (ecdsa-sha2 (curve " + curve + ") (x #01#) (y #02#)))"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := EvalPublicKey(s); !errors.As(err, &curveErr) || curveErr.Curve != curve {
+			t.Errorf("Expected an UnsupportedCurveError for %s; got %v", curve, err)
+		}
+	}
+	sk, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublicKeyFromECDSA(&sk.PublicKey); !errors.As(err, &curveErr) || curveErr.Curve != "P-521" {
+		t.Error("Expected an UnsupportedCurveError for P-521; got", err)
+	}
+	key := PrivateKey{HashKey{}, *sk}
+	if _, err := key.Sign(sexprs.Atom{Value: []byte("test")}); !errors.As(err, &curveErr) {
+		t.Error("Expected an UnsupportedCurveError signing with P-521; got", err)
+	}
+}
+
+func TestPublicKey_SexpErr(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := PrivateKey{HashKey{}, *sk}
+	var curveErr UnsupportedCurveError
+	if s, err := key.PublicKey().SexpErr(); s != nil || !errors.As(err, &curveErr) {
+		t.Error("Expected an UnsupportedCurveError; got", s, err)
+	}
+	if s, err := key.SexpErr(); s != nil || !errors.As(err, &curveErr) {
+		t.Error("Expected an UnsupportedCurveError; got", s, err)
+	}
+	if key.PublicKey().Sexp() != nil || key.Sexp() != nil {
+		t.Error("Keys on unsupported curves should have nil S-expressions")
+	}
+	if key.PublicKey().String() != "" || key.PublicKey().Pack() != nil || key.String() != "" || key.Pack() != nil {
+		t.Error("Keys on unsupported curves should have empty string forms")
+	}
+	if _, err := key.PublicKey().MarshalPEM(); !errors.As(err, &curveErr) {
+		t.Error("Expected an UnsupportedCurveError; got", err)
+	}
+}
+
+func TestPackString(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	sig, err := key.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("test"))
+	hash := Hash{Algorithm: "sha256", Hash: sum[:]}
+	notAfter := time.Date(2014, 12, 31, 23, 59, 0, 0, time.UTC)
+	rsaKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsaKey.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		v    interface {
+			Pack() []byte
+			String() string
+		}
+	}{
+		{"Hash", hash},
+		{"PublicKey", key.PublicKey()},
+		{"PrivateKey", key},
+		{"Signature", sig},
+		{"AuthCert", cert},
+		{"NameCert", NameCert{Issuer: Name{key.PublicKey(), []string{"alice"}}, Subject: hash}},
+		{"Name", &Name{key.PublicKey(), []string{"alice", "bob"}}},
+		{"Valid", Valid{NotAfter: &notAfter}},
+		{"OnlineTest", OnlineTest{Type: "crl", Principal: key.PublicKey(), ID: []byte("test")}},
+		{"Sequence", Sequence{cert, sig}},
+		{"RSAPublicKey", rsaKey.RSAPublicKey()},
+		{"RSAPrivateKey", rsaKey},
+		{"RSASignature", rsaSig},
+	}
+	for _, test := range tests {
+		packed, _, err := sexprs.Parse(test.v.Pack())
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+		advanced, _, err := sexprs.Parse([]byte(test.v.String()))
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+		if !packed.Equal(advanced) {
+			t.Errorf("%s: canonical %s and advanced %s forms differ", test.name, packed, advanced)
+		}
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	sig, err := key.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("test"))
+	hash := Hash{Algorithm: "sha256", Hash: sum[:]}
+	tests := []struct {
+		name string
+		v    interface {
+			Pack() []byte
+			WriteTo(io.Writer) (int64, error)
+		}
+	}{
+		{"Hash", hash},
+		{"PublicKey", key.PublicKey()},
+		{"Signature", sig},
+		{"AuthCert", cert},
+		{"Sequence", Sequence{key.PublicKey(), cert, sig}},
+	}
+	for _, test := range tests {
+		var buf writeCounter
+		n, err := test.v.WriteTo(&buf)
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+		if n != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), test.v.Pack()) {
+			t.Errorf("%s: WriteTo wrote %d bytes %q; expected %q", test.name, n, buf.Bytes(), test.v.Pack())
+		}
+		if buf.writes != 1 {
+			t.Errorf("%s: WriteTo made %d writes; expected 1", test.name, buf.writes)
+		}
+	}
+	// a long sequence is written in a few large writes, not one per
+	// element or token
+	var seq Sequence
+	for i := 0; i < 100; i++ {
+		seq = append(seq, cert, sig)
+	}
+	var buf writeCounter
+	n, err := seq.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), seq.Pack()) {
+		t.Errorf("Sequence: WriteTo wrote %d bytes; expected %d", n, len(seq.Pack()))
+	}
+	if max := buf.Len()/4096 + 1; buf.writes > max {
+		t.Errorf("Sequence: WriteTo made %d writes of %d bytes; expected at most %d", buf.writes, buf.Len(), max)
+	}
+}
+
+// A writeCounter is a bytes.Buffer which counts the writes made to it.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func benchmarkSequence(b *testing.B) Sequence {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var seq Sequence
+	for i := 0; i < 100; i++ {
+		cert := key.IssueAuthCert(key.PublicKey(), sexprs.List{sexprs.Atom{Value: []byte("dns")}}, Valid{})
+		sig, err := key.Sign(cert.Sexp())
+		if err != nil {
+			b.Fatal(err)
+		}
+		seq = append(seq, cert, sig)
+	}
+	return seq
+}
+
+func BenchmarkSequence_Pack(b *testing.B) {
+	seq := benchmarkSequence(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.Discard.Write(seq.Pack()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSequence_WriteTo(b *testing.B) {
+	seq := benchmarkSequence(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := seq.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHash_JSON(t *testing.T) {
+	sum := sha256.Sum256([]byte("test"))
+	uri, err := url.Parse("http://example.com/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []Hash{
+		{Algorithm: "sha256", Hash: sum[:]},
+		{Algorithm: "sha256", Hash: sum[:], URIs: URIs{uri}},
+	} {
+		data, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h2 Hash
+		if err := json.Unmarshal(data, &h2); err != nil {
+			t.Fatal(err)
+		}
+		if !h.Equal(h2) || len(h2.URIs) != len(h.URIs) {
+			t.Errorf("Round-tripping %s through %s yielded %s", h, data, h2)
+		}
+		for i := range h.URIs {
+			if h.URIs[i].String() != h2.URIs[i].String() {
+				t.Errorf("Round-tripping %s through %s yielded %s", h, data, h2)
+			}
+		}
+	}
+	var h Hash
+	for _, data := range []string{
+		`{"algorithm":"md5","hash":"CY9rzUYh03PK3k6DJie09g=="}`,
+		`{"algorithm":"sha256","hash":"CY9rzUYh03PK3k6DJie09g=="}`,
+	} {
+		if err := json.Unmarshal([]byte(data), &h); err == nil {
+			t.Error("Expected an error unmarshaling", data)
+		}
+	}
+}
+
+func TestHash_Equal(t *testing.T) {
+	sum := sha256.Sum256([]byte("test"))
+	other := sha256.Sum256([]byte("other"))
+	h := Hash{Algorithm: "sha256", Hash: sum[:]}
+	tests := []struct {
+		h2    Hash
+		equal bool
+	}{
+		{Hash{Algorithm: "sha256", Hash: append([]byte(nil), sum[:]...)}, true},
+		{Hash{Algorithm: "sha256", Hash: sum[:], URIs: URIs{&url.URL{Scheme: "http", Host: "example.com"}}}, true},
+		{Hash{Algorithm: "sha256", Hash: other[:]}, false},
+		{Hash{Algorithm: "sha256", Hash: sum[:16]}, false},
+		{Hash{Algorithm: "sha3-256", Hash: sum[:]}, false},
+		{Hash{}, false},
+	}
+	for _, test := range tests {
+		if h.Equal(test.h2) != test.equal || test.h2.Equal(h) != test.equal {
+			t.Errorf("Expected %s.Equal(%s) to be %v", h, test.h2, test.equal)
+		}
+	}
+	if !(Hash{}).Equal(Hash{Hash: []byte{}}) {
+		t.Error("Empty digests should be equal")
+	}
+}
+
+func TestPrivateKey_IssueAuthCertWithin(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jan := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	jun := time.Date(2014, time.June, 30, 0, 0, 0, 0, time.UTC)
+	dec := time.Date(2014, time.December, 31, 0, 0, 0, 0, time.UTC)
+	next := time.Date(2015, time.June, 30, 0, 0, 0, 0, time.UTC)
+	tag := sexprs.List{sexprs.Atom{Value: []byte("dns")}}
+	cert, err := key.IssueAuthCertWithin(key.PublicKey(), tag, Valid{NotBefore: &jan, NotAfter: &next}, Valid{NotBefore: &jun, NotAfter: &dec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Valid.NotBefore.Equal(jun) || !cert.Valid.NotAfter.Equal(dec) {
+		t.Error("Expected validity to be clamped to the issuer's; got", cert.Valid)
+	}
+	cert, err = key.IssueAuthCertWithin(key.PublicKey(), tag, Valid{NotAfter: &dec}, Valid{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Valid.NotBefore != nil || !cert.Valid.NotAfter.Equal(dec) {
+		t.Error("Expected validity to be unchanged; got", cert.Valid)
+	}
+	if _, err := key.IssueAuthCertWithin(key.PublicKey(), tag, Valid{NotBefore: &jan, NotAfter: &jun}, Valid{NotBefore: &dec}); err == nil {
+		t.Error("Expected an error for disjoint validities")
+	}
+}
+
+func TestReduce_DelegationDepth(t *testing.T) {
+	var keys []*PrivateKey
+	for i := 0; i < 4; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	var certs []*AuthCert
+	for i := 0; i < 3; i++ {
+		cert := testCert(t, keys[i], keys[i+1].PublicKey(), "(dns com.example.)")
+		certs = append(certs, &cert)
+	}
+	// keys[1] may delegate once more, so keys[2] may not delegate
+	certs[0].Depth = 1
+	result, err := Reduce(certs[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Delegate {
+		t.Error("Expected the delegation depth to be exhausted; got", result.Depth)
+	}
+	if _, err := Reduce(certs); err == nil {
+		t.Error("Expected an error reducing beyond the delegation depth")
+	}
+	// a later certificate may further restrict the depth, but not
+	// extend it
+	certs[0].Depth = 3
+	certs[1].Depth = 1
+	result, err = Reduce(certs[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Delegate || result.Depth != 1 {
+		t.Error("Expected a delegation depth of 1; got", result.Delegate, result.Depth)
+	}
+	certs[0].Depth = 2
+	certs[1].Depth = 0
+	result, err = Reduce(certs[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Delegate || result.Depth != 1 {
+		t.Error("Expected a delegation depth of 1; got", result.Delegate, result.Depth)
+	}
+	if _, err := Reduce(certs); err != nil {
+		t.Error(err)
+	}
+	// unlimited delegation
+	certs[0].Depth = 0
+	result, err = Reduce(certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Delegate || result.Depth != 0 {
+		t.Error("Expected unlimited delegation; got", result.Delegate, result.Depth)
+	}
+}
+
+func TestEvalAuthCert(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, depth := range []int{0, 2} {
+		cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+		cert.Depth = depth
+		cert2, err := EvalAuthCert(cert.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.SemanticEqual(&cert2) {
+			t.Errorf("Expected %s; got %s", cert, cert2)
+		}
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	cert.Delegate = false
+	cert2, err := EvalAuthCert(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert2.Delegate || !cert.SemanticEqual(&cert2) {
+		t.Errorf("Expected %s; got %s", cert, cert2)
+	}
+	bad := cert.Sexp().(sexprs.List)
+	bad = append(bad[:3:3], sexprs.List{delegateAtom, sexprs.Atom{Value: []byte("-1")}}, cert.Tag)
+	if _, err := EvalAuthCert(bad); err == nil {
+		t.Error("Expected an error evaluating", bad)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	var keys []*PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	cert1 := testCert(t, keys[0], keys[1].PublicKey(), "(dns (* prefix com.))")
+	hash, err := keys[2].PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag2, _, err := sexprs.Parse([]byte("(dns (* prefix com.example.))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert2 := keys[1].IssueAuthCert(hash, tag2, *cert1.Valid)
+	sig1, err := keys[0].Sign(cert1.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := keys[1].Sign(cert2.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := Sequence{cert1, sig1, cert2, sig2}
+	at := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		root    *PublicKey
+		subject Subject
+		tag     string
+		at      time.Time
+		ok      bool
+	}{
+		{keys[0].PublicKey(), keys[2].PublicKey(), "(dns com.example.www.)", at, true},
+		{keys[0].PublicKey(), hash, "(dns com.example.www.)", at, true},
+		{keys[0].PublicKey(), keys[1].PublicKey(), "(dns org.example.www.)", at, false},
+		{keys[0].PublicKey(), keys[1].PublicKey(), "(dns net.example.www.)", at, false},
+		{keys[0].PublicKey(), keys[2].PublicKey(), "(dns net.example.www.)", at, false},
+		{keys[0].PublicKey(), keys[2].PublicKey(), "(dns (* prefix com.))", at, false},
+		{keys[1].PublicKey(), keys[2].PublicKey(), "(dns com.example.www.)", at, true},
+		{keys[2].PublicKey(), keys[2].PublicKey(), "(dns com.example.www.)", at, false},
+		{keys[0].PublicKey(), keys[2].PublicKey(), "(dns com.example.www.)", at.AddDate(1, 0, 0), false},
+	}
+	for i, test := range tests {
+		tag, _, err := sexprs.Parse([]byte(test.tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := Authorize(seq, test.root, test.subject, tag, test.at)
+		if ok != test.ok {
+			t.Errorf("Test %d: expected %v; got %v (%v)", i, test.ok, ok, err)
+		}
+	}
+	// an unsigned certificate confers nothing
+	tag, _, _ := sexprs.Parse([]byte("(dns com.example.www.)"))
+	if ok, _ := Authorize(Sequence{cert1, sig1, cert2}, keys[0].PublicKey(), hash, tag, at); ok {
+		t.Error("Unsigned certificate authorised its subject")
+	}
+	// nor does a sequence with a signature of nothing
+	if ok, err := Authorize(Sequence{sig1, cert1, sig1, cert2, sig2}, keys[0].PublicKey(), hash, tag, at); ok || err == nil {
+		t.Error("Expected an error authorizing with a bad signature")
+	}
+}
+
+// signedSequence returns certs, each followed by its issuer's signature.
+func signedSequence(t *testing.T, certs []AuthCert, issuers []*PrivateKey) Sequence {
+	var seq Sequence
+	for i, cert := range certs {
+		sig, err := issuers[i].Sign(cert.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq = append(seq, cert, sig)
+	}
+	return seq
+}
+
+// Layers of keys each delegating to every key in the next give
+// exponentially many chains, but Authorize explores each reduction of
+// them only once, and so still answers promptly.
+func TestAuthorize_Layered(t *testing.T) {
+	const k, layers = 2, 30
+	root, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuers := []*PrivateKey{root}
+	var certs []AuthCert
+	var signers []*PrivateKey
+	for i := 0; i <= layers; i++ {
+		n := k
+		if i == layers {
+			n = 1 // the subject
+		}
+		var layer []*PrivateKey
+		for j := 0; j < n; j++ {
+			key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+			if err != nil {
+				t.Fatal(err)
+			}
+			layer = append(layer, key)
+			for _, issuer := range issuers {
+				certs = append(certs, testCert(t, issuer, key.PublicKey(), "(dns (* prefix com.))"))
+				signers = append(signers, issuer)
+			}
+		}
+		issuers = layer
+	}
+	seq := signedSequence(t, certs, signers)
+	subject := issuers[0].PublicKey()
+	at := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		tag string
+		ok  bool
+	}{
+		{"(ftp com.example.)", false},
+		{"(dns com.example.)", true},
+	}
+	for _, test := range tests {
+		tag, _, err := sexprs.Parse([]byte(test.tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		var ok bool
+		go func() {
+			var err error
+			ok, err = Authorize(seq, root.PublicKey(), subject, tag, at)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil || ok != test.ok {
+				t.Errorf("Expected %v authorising %s; got %v, %v", test.ok, tag, ok, err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("Authorising %s through %d layers took more than a minute", tag, layers)
+		}
+	}
+}
+
+// The error Authorize returns is that of the first chain which fails,
+// not the last.
+func TestAuthorize_FirstFailure(t *testing.T) {
+	var keys []*PrivateKey
+	for i := 0; i < 4; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	root, other, via, subject := keys[0], keys[1], keys[2], keys[3]
+	undelegated := testCert(t, root, other.PublicKey(), "(ftp)")
+	undelegated.Delegate = false
+	certs := []AuthCert{
+		undelegated,
+		testCert(t, other, subject.PublicKey(), "(ftp)"),
+		testCert(t, root, via.PublicKey(), "(ftp)"),
+		testCert(t, via, subject.PublicKey(), "(dns)"),
+	}
+	seq := signedSequence(t, certs, []*PrivateKey{root, other, root, via})
+	tag, _, err := sexprs.Parse([]byte("(ftp com.example.)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	ok, err := Authorize(seq, root.PublicKey(), subject.PublicKey(), tag, at)
+	if ok || err == nil || !strings.Contains(err.Error(), "may not be delegated") {
+		t.Error("Expected the undelegated chain's error; got", ok, err)
+	}
+}
+
+// Chains whose tags differ only in a display hint reduce alike, & so
+// may share their exploration: neither may be refused for its hint.
+func TestAuthorize_DisplayHint(t *testing.T) {
+	var keys []*PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	root, middle, subject := keys[0], keys[1], keys[2]
+	certs := []AuthCert{
+		testCert(t, root, middle.PublicKey(), "(ftp [text/plain]host)"),
+		testCert(t, root, middle.PublicKey(), "(ftp host)"),
+		testCert(t, middle, subject.PublicKey(), "(ftp host)"),
+	}
+	seq := signedSequence(t, certs, []*PrivateKey{root, root, middle})
+	tag, _, err := sexprs.Parse([]byte("(ftp host)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	ok, err := Authorize(seq, root.PublicKey(), subject.PublicKey(), tag, at)
+	if !ok || err != nil {
+		t.Error("Expected the chain to authorise", tag, "; got", ok, err)
+	}
+}
+
+// A countingSignature counts the times it is verified.
+type countingSignature struct {
+	*Signature
+	count *int
+}
+
+func (sig countingSignature) Verify(s sexprs.Sexp) error {
+	*sig.count++
+	return sig.Signature.Verify(s)
+}
+
+func TestAuthorize_VerifiesOnce(t *testing.T) {
+	key1, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key1, key2.PublicKey(), "(dns (* prefix com.))")
+	sig, err := key1.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	seq := Sequence{cert, countingSignature{sig, &count}}
+	tag, _, _ := sexprs.Parse([]byte("(dns com.example.)"))
+	at := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	if ok, err := Authorize(seq, key1.PublicKey(), key2.PublicKey(), tag, at); !ok {
+		t.Fatal("Certificate did not authorise its subject", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected the signature to be verified once; it was verified %d times", count)
+	}
+}
+
+// Verify stops at the first element a signature verifies against, and
+// Coverage does not verify again what Verify already has.
+func TestSequence_VerifyLazily(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 5
+	count := 0
+	var seq Sequence
+	for i := 0; i < n; i++ {
+		cert := testCert(t, key, key.PublicKey(), fmt.Sprintf("(dns %d.example.com.)", i))
+		sig, err := key.Sign(cert.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq = append(seq, cert, countingSignature{sig, &count})
+	}
+	if err := seq.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("Expected Verify to verify %d times; it verified %d", n, count)
+	}
+	count = 0
+	v := seq.verify()
+	if err := v.err(); err != nil {
+		t.Fatal(err)
+	}
+	coverage := v.coverage()
+	if count != n*n {
+		t.Errorf("Expected %d verifications in all; got %d", n*n, count)
+	}
+	if len(coverage) != n {
+		t.Errorf("Expected %d covered elements; got %d", n, len(coverage))
+	}
+}
+
+func TestAuthorize_Self(t *testing.T) {
+	root, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, root, subject.PublicKey(), "(dns (* prefix com.example.))")
+	cert.Issuer = Name{}
+	if _, err := Reduce([]*AuthCert{&cert}); err == nil {
+		t.Error("Expected an error reducing a certificate issued by Self")
+	}
+	if _, err := Reduce([]*AuthCert{cert.resolveSelf(root.PublicKey())}); err != nil {
+		t.Error(err)
+	}
+	sig, err := root.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSig, err := other.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, _, err := sexprs.Parse([]byte("(dns com.example.www.)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	for i, test := range []struct {
+		seq  Sequence
+		root *PublicKey
+		ok   bool
+	}{
+		{Sequence{cert, sig}, root.PublicKey(), true},
+		{Sequence{cert, sig}, other.PublicKey(), false},
+		{Sequence{cert, otherSig}, root.PublicKey(), false},
+		{Sequence{cert}, root.PublicKey(), false},
+	} {
+		ok, err := Authorize(test.seq, test.root, subject.PublicKey(), tag, at)
+		if ok != test.ok {
+			t.Errorf("Test %d: expected %v; got %v (%v)", i, test.ok, ok, err)
+		}
+	}
+}
+
+func TestHashKey_Sexp(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk := HashKey{[]Hash{hash}}
+	if !hk.Sexp().Equal(hk.Subject()) {
+		t.Error("HashKey's Sexp and Subject differ")
+	}
+	sexp, _, err := sexprs.Parse(hk.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := EvalHash(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hash.Equal(hash2) || !(HashKey{[]Hash{hash2}}).Equal(key) {
+		t.Error("Expected", hash, "; got", hash2)
+	}
+	if hk.String() != hash.String() {
+		t.Error("Expected", hash.String(), "; got", hk.String())
+	}
+	if (HashKey{}).Sexp() != nil || (HashKey{}).Pack() != nil || (HashKey{}).String() != "" {
+		t.Error("Empty HashKey should have no S-expression")
+	}
+}
+
+func TestEvalSignatureDeferred(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig, err := key.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sexp := sig.Sexp().(sexprs.List)
+	sexp[2] = hash.Sexp()
+	u, err := EvalSignatureDeferred(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk, ok := u.Principal.(HashKey)
+	if !ok || len(hk.Hashes) != 1 || !hk.Hashes[0].Equal(hash) {
+		t.Fatal("Expected the principal to be retained as a HashKey; got", u.Principal)
+	}
+	if !u.Sexp().Equal(sexp) {
+		t.Error("Unresolved signature did not survive a round-trip")
+	}
+	if _, err := u.Resolve(nil); err == nil {
+		t.Error("Expected a HashNotFoundError resolving without a lookup")
+	}
+	sig2, err := u.Resolve(func(h Hash) *PublicKey {
+		if h.Equal(hash) {
+			return key.PublicKey()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sig2.Equal(sig) {
+		t.Error("Expected", sig, "; got", sig2)
+	}
+	if err = sig2.Verify(message); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHashKey_BestHash(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []Hash
+	for _, algorithm := range []string{"sha256", "sha512", "sha224"} {
+		hash, err := key.PublicKey().HashExp(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	hk := HashKey{hashes}
+	best, ok := hk.BestHash()
+	if !ok || best.Algorithm != "sha512" {
+		t.Error("Expected sha512 to be chosen; got", best)
+	}
+	if !hk.Subject().Equal(hashes[1].Sexp()) || !hk.Sexp().Equal(hashes[1].Sexp()) {
+		t.Error("Expected the sha512 hash as subject; got", hk.Subject())
+	}
+	if _, ok := (HashKey{}).BestHash(); ok {
+		t.Error("Empty HashKey has a best hash")
+	}
+}
+
+func TestECDSAKeys_DistinguishedByCurve(t *testing.T) {
+	for _, test := range []struct {
+		curve string
+		c     elliptic.Curve
+	}{
+		{"p256", elliptic.P256()},
+		{"p384", elliptic.P384()},
+	} {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve " + test.curve + "))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sexp, _, err := sexprs.Parse(key.PublicKey().Pack())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk, err := EvalPublicKey(sexp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pk.Pk.Curve != test.c || !pk.Equal(key.PublicKey()) {
+			t.Errorf("Expected a %s public key; got %s", test.curve, pk)
+		}
+		sexp, _, err = sexprs.Parse(key.Pack())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sk, err := EvalPrivateKey(sexp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sk.Curve != test.c || !sk.Equal(key) {
+			t.Errorf("Expected a %s private key; got %s", test.curve, &sk)
+		}
+	}
+}
+
+func TestEvalDoHash(t *testing.T) {
+	for _, test := range []struct {
+		s, algorithm string
+	}{
+		{"(do hash sha256)", "sha256"},
+		{"(do hash sha512)", "sha512"},
+		{"(do hash md5)", ""},
+		{"(do hash)", ""},
+		{"(do hash sha256 extra)", ""},
+		{"(do hash (sha256))", ""},
+		{"(do something sha256)", ""},
+		{"(hash sha256)", ""},
+		{"do", ""},
+	} {
+		s, _, err := sexprs.Parse([]byte(test.s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		algorithm, err := EvalDoHash(s)
+		switch {
+		case test.algorithm == "" && err == nil:
+			t.Error("Expected an error evaluating", test.s)
+		case test.algorithm != "" && (err != nil || algorithm != test.algorithm):
+			t.Errorf("Expected %s evaluating %s; got %s (%v)", test.algorithm, test.s, algorithm, err)
+		}
+	}
+}
+
+func TestIntersectTags_DoHash(t *testing.T) {
+	object := sexprs.Atom{Value: []byte("file contents")}
+	directive, _, err := sexprs.Parse([]byte("(do hash sha256)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := DoHash(directive, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hash.VerifySexp(object) {
+		t.Error("DoHash returned the wrong hash", hash)
+	}
+	granted := sexprs.List{sexprs.Atom{Value: []byte("read")}, hash.Sexp()}
+	request := sexprs.List{sexprs.Atom{Value: []byte("read")}, append(directive.(sexprs.List), object)}
+	tag, err := IntersectTags(granted, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tag.Equal(granted) {
+		t.Error("Expected", granted, "; got", tag)
+	}
+	other := sexprs.List{sexprs.Atom{Value: []byte("read")}, append(directive.(sexprs.List), sexprs.Atom{Value: []byte("other")})}
+	if tag, err := IntersectTags(granted, other); err != nil || tag != nil {
+		t.Error("Expected no intersection; got", tag, err)
+	}
+	// a directive without an object is an ordinary tag
+	incomplete := sexprs.List{sexprs.Atom{Value: []byte("read")}, directive}
+	if tag, err := IntersectTags(granted, incomplete); err != nil || tag != nil {
+		t.Error("Expected no intersection; got", tag, err)
+	}
+	bad, _, err := sexprs.Parse([]byte("(read (do hash md5 contents))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IntersectTags(granted, bad); err == nil {
+		t.Error("Expected an error intersecting", bad)
+	}
+}
+
+// Lists beginning with do are ordinary tags unless they are hash
+// directives.
+func TestIntersectTags_DoTag(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"(do backup)", "(app (do backup))", "(do hash)", "(app (do hash sha256 a b))"} {
+		s, _, err := sexprs.Parse([]byte(tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		star := sexprs.List{starAtom}
+		if result, err := IntersectTags(star, s); err != nil || result == nil || !result.Equal(s) {
+			t.Errorf("Expected %s; got %v (%v)", tag, result, err)
+		}
+		if !TagContains(s, s) {
+			t.Errorf("%s should contain itself", tag)
+		}
+		cert1 := testCert(t, key, key.PublicKey(), tag)
+		cert2 := testCert(t, key, key.PublicKey(), tag)
+		if _, err := Reduce([]*AuthCert{&cert1, &cert2}); err != nil {
+			t.Errorf("Reducing certificates with tag %s: %v", tag, err)
+		}
+	}
+}
+
+func TestKeyStore(t *testing.T) {
+	ks := NewKeyStore()
+	var keys []*PublicKey
+	for i := 0; i < 2; i++ {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ks.Add(key.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key.PublicKey())
+	}
+	for _, key := range keys {
+		for _, algorithm := range []string{"sha256", "sha512"} {
+			hash, err := key.HashExp(algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := ks.Lookup(hash); found == nil || !found.Equal(key) {
+				t.Errorf("Expected %s looking up %s; got %s", key, hash, found)
+			}
+		}
+	}
+	unknown, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := unknown.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := ks.Lookup(hash); found != nil {
+		t.Error("Expected no key; got", found)
+	}
+	// usable as a lookup function
+	sig, err := unknown.Sign(sexprs.Atom{Value: []byte("message")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sexp := sig.Sexp().(sexprs.List)
+	sexp[2] = hash.Sexp()
+	if _, err := EvalSignature(sexp, ks.Lookup); err == nil {
+		t.Error("Expected a HashNotFoundError")
+	}
+	if err := ks.Add(unknown.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EvalSignature(sexp, ks.Lookup); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEval(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := GenerateRSAKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	sig, err := key.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := &Name{key.PublicKey(), []string{"alice"}}
+	nameCert := NameCert{Issuer: *name, Subject: hash}
+	notAfter := time.Date(2014, 12, 31, 23, 59, 0, 0, time.UTC)
+	tests := []struct {
+		s        sexprs.Sexp
+		expected interface{}
+	}{
+		{hash.Sexp(), Hash{}},
+		{key.PublicKey().Sexp(), &PublicKey{}},
+		{key.Sexp(), &PrivateKey{}},
+		{rsaKey.RSAPublicKey().Sexp(), &RSAPublicKey{}},
+		{rsaKey.Sexp(), &RSAPrivateKey{}},
+		{sig.Sexp(), &Signature{}},
+		{cert.Sexp(), AuthCert{}},
+		{nameCert.Sexp(), NameCert{}},
+		{Sequence{key.PublicKey(), cert, sig}.Sexp(), Sequence{}},
+		{name.Sexp(), &Name{}},
+		{Valid{NotAfter: &notAfter}.Sexp(), Valid{}},
+	}
+	for _, test := range tests {
+		v, err := Eval(test.s, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprintf("%T", v) != fmt.Sprintf("%T", test.expected) {
+			t.Errorf("Expected a %T evaluating %s; got %T", test.expected, test.s, v)
+			continue
+		}
+		if s := v.(SequenceElement).Sexp(); !s.Equal(test.s) {
+			t.Errorf("Expected %s; got %s", test.s, s)
+		}
+	}
+	for _, s := range []sexprs.Sexp{
+		sexprs.List{sexprs.Atom{Value: []byte("unknown")}},
+		sexprs.List{},
+		sexprs.Atom{Value: []byte("hash")},
+		sexprs.List{sexprs.List{}},
+		sexprs.List{sequenceAtom, sexprs.List{sexprs.Atom{Value: []byte("unknown")}}},
+	} {
+		if _, err := Eval(s, nil); err == nil {
+			t.Error("Expected an error evaluating", s)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	f, err := os.CreateTemp("", "spki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// one canonical & one advanced expression
+	if _, err := f.Write(key.PublicKey().Pack()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "\n"+cert.String()+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := ParseFile(f.Name(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatal("Expected 2 objects; got", len(objects))
+	}
+	if k, ok := objects[0].(*PublicKey); !ok || !k.Equal(key.PublicKey()) {
+		t.Error("Expected", key.PublicKey(), "; got", objects[0])
+	}
+	if c, ok := objects[1].(AuthCert); !ok || !c.SemanticEqual(&cert) {
+		t.Error("Expected", cert, "; got", objects[1])
+	}
+	if _, err := ParseReader(strings.NewReader("(hash sha256"), nil); err == nil {
+		t.Error("Expected an error parsing a truncated expression")
+	}
+	if objects, err := ParseReader(strings.NewReader("  \n"), nil); err != nil || len(objects) != 0 {
+		t.Error("Expected no objects; got", objects, err)
+	}
+	if _, err := ParseFile(f.Name()+".missing", nil); err == nil {
+		t.Error("Expected an error parsing a missing file")
+	}
+}
+
+func TestHash_Hex(t *testing.T) {
+	// SHA-256 of "abc", from FIPS 180-2
+	const digest = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	h, err := HashObject("sha256", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Hex() != digest {
+		t.Error("Expected", digest, "; got", h.Hex())
+	}
+	if h.Base64() != "ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=" {
+		t.Error("Unexpected base64 digest", h.Base64())
+	}
+	h2, err := ParseHashHex("sha256", strings.ToUpper(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Equal(h2) {
+		t.Error("Expected", h, "; got", h2)
+	}
+	for _, test := range []struct{ algorithm, digest string }{
+		{"md5", digest},
+		{"sha256", digest[:62]},
+		{"sha256", digest[:63]},
+		{"sha256", "zz" + digest[2:]},
+		{"sha512", digest},
+	} {
+		if _, err := ParseHashHex(test.algorithm, test.digest); err == nil {
+			t.Error("Expected an error parsing", test)
+		}
+	}
+}
+
+// truncations returns every S-expression which can be made from s by
+// truncating one of its lists, or replacing one of its elements with an
+// empty list.
+func truncations(s sexprs.Sexp) (results []sexprs.Sexp) {
+	l, ok := s.(sexprs.List)
+	if !ok {
+		return []sexprs.Sexp{sexprs.List{}}
+	}
+	for i := 0; i < len(l); i++ {
+		results = append(results, append(sexprs.List{}, l[:i]...))
+		for _, t := range truncations(l[i]) {
+			replaced := append(sexprs.List{}, l...)
+			replaced[i] = t
+			results = append(results, replaced)
+		}
+	}
+	return results
+}
+
+func TestEval_Truncated(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := GenerateRSAKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	sig, err := key.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash.URIs = URIs{uri}
+	name := &Name{key.PublicKey(), []string{"alice"}}
+	nameCert := NameCert{Issuer: *name, Subject: hash}
+	notAfter := time.Date(2014, 12, 31, 23, 59, 0, 0, time.UTC)
+	online := OnlineTest{Type: "crl", URIs: URIs{uri}, Principal: key.PublicKey()}
+	lookup := func(Hash) *PublicKey { return key.PublicKey() }
+	parsers := map[string]func(sexprs.Sexp) error{
+		"Eval":           func(s sexprs.Sexp) error { _, err := Eval(s, lookup); return err },
+		"EvalAuthCert":   func(s sexprs.Sexp) error { _, err := EvalAuthCert(s); return err },
+		"EvalHash":       func(s sexprs.Sexp) error { _, err := EvalHash(s); return err },
+		"EvalName":       func(s sexprs.Sexp) error { _, err := EvalName(s); return err },
+		"EvalNameCert":   func(s sexprs.Sexp) error { _, err := EvalNameCert(s); return err },
+		"EvalOnlineTest": func(s sexprs.Sexp) error { _, err := EvalOnlineTest(s); return err },
+		"EvalPrivateKey": func(s sexprs.Sexp) error { _, err := EvalPrivateKey(s); return err },
+		"EvalPublicKey":  func(s sexprs.Sexp) error { _, err := EvalPublicKey(s); return err },
+		"EvalRSAPrivateKey": func(s sexprs.Sexp) error {
+			_, err := EvalRSAPrivateKey(s)
+			return err
+		},
+		"EvalRSAPublicKey": func(s sexprs.Sexp) error {
+			_, err := EvalRSAPublicKey(s)
+			return err
+		},
+		"EvalSignature": func(s sexprs.Sexp) error { _, err := EvalSignature(s, lookup); return err },
+		"EvalURIs":      func(s sexprs.Sexp) error { _, err := EvalURIs(s); return err },
+		"EvalValid":     func(s sexprs.Sexp) error { _, err := EvalValid(s); return err },
+	}
+	inputs := []sexprs.Sexp{
+		hash.Sexp(),
+		key.PublicKey().Sexp(),
+		key.Sexp(),
+		rsaKey.RSAPublicKey().Sexp(),
+		rsaKey.Sexp(),
+		sig.Sexp(),
+		cert.Sexp(),
+		nameCert.Sexp(),
+		Sequence{key.PublicKey(), cert, sig}.Sexp(),
+		name.Sexp(),
+		Valid{NotAfter: &notAfter, Online: []OnlineTest{online}}.Sexp(),
+		online.Sexp(),
+		hash.URIs.Sexp(),
+	}
+	for _, input := range inputs {
+		for _, s := range append(truncations(input), sexprs.List{}, sexprs.Atom{}) {
+			for name, parse := range parsers {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("%s panicked evaluating %s: %v", name, s, r)
+						}
+					}()
+					parse(s)
+				}()
+			}
+		}
+	}
+}
+
+func TestSafeEval(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := SafeEval(key.PublicKey().Pack(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := v.(*PublicKey); !ok || !k.Equal(key.PublicKey()) {
+		t.Error("Expected", key.PublicKey(), "; got", v)
+	}
+	for _, data := range []string{
+		"",
+		"(",
+		"(unknown)",
+		"(hash sha256 |AAAA|) (hash sha256 |AAAA|)",
+	} {
+		if _, err := SafeEval([]byte(data), nil); err == nil {
+			t.Errorf("Expected an error evaluating %q", data)
+		}
+	}
+	// a lookup function which panics
+	sig, err := key.Sign(sexprs.Atom{Value: []byte("message")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sexp := sig.Sexp().(sexprs.List)
+	sexp[2] = hash.Sexp()
+	if _, err := SafeEval(sexp.Pack(), func(Hash) *PublicKey { panic("lookup failed") }); err == nil {
+		t.Error("Expected a panic to be returned as an error")
+	}
+}
+
+func FuzzEval(f *testing.F) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		f.Fatal(err)
+	}
+	cert := key.IssueAuthCert(key.PublicKey(), sexprs.List{sexprs.Atom{Value: []byte("dns")}}, Valid{})
+	sig, err := key.Sign(cert.Sexp())
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, s := range []SequenceElement{key.PublicKey(), key, cert, sig, Sequence{key.PublicKey(), cert, sig}} {
+		f.Add(s.Sexp().Pack())
+		f.Add([]byte(s.String()))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		SafeEval(data, nil)
+	})
+}
+
+func TestEvalPrivateKey_P384(t *testing.T) {
+	// the P-384 key of RFC 6979, appendix A.2.6
+	x := "EC3A4E415B4E19A4568618029F427FA5DA9A8BC4AE92E02E06AAE5286B300C64DEF8F0EA9055866064A254515480BC13"
+	y := "8015D9B72D7D57244EA8EF9AC0C621896708A59367F9DFB9F54CA84B3F1C9DB1288B231C3AE0D4FE7344FD2533264720"
+	d := "6B9D3DAD2E1B8C1C05B19875B6659F4DE23C3B667BF297BA9AA47740787137D896D5724E4C70A825F872C9EA60D2EDF5"
+	sexp, _, err := sexprs.Parse([]byte("(private-key (ecdsa-sha2 (curve p384) (x #" + x + "#) (y #" + y + "#) (d #" + d + "#)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := EvalPrivateKey(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Curve != elliptic.P384() || key.D == nil || key.X == nil || key.Y == nil {
+		t.Fatal("Expected a p384 key; got", key)
+	}
+	if fmt.Sprintf("%096X", key.D) != d {
+		t.Errorf("Expected d %s; got %X", d, key.D)
+	}
+	if gx, gy := elliptic.P384().ScalarBaseMult(key.D.Bytes()); gx.Cmp(key.X) != 0 || gy.Cmp(key.Y) != 0 {
+		t.Error("Private key does not match its public key")
+	}
+	// a malformed term must not yield a partial key
+	l := sexp.(sexprs.List)
+	terms := append(sexprs.List{}, l[1].(sexprs.List)...)
+	terms[4] = sexprs.List{sexprs.Atom{Value: []byte("d")}}
+	key, err = EvalPrivateKey(sexprs.List{l[0], terms})
+	if err == nil || key.D != nil || key.X != nil || key.Curve != nil {
+		t.Error("Expected an error and a zero key; got", err, key)
+	}
+}
+
+func TestAuthCert_Equal(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	same := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	otherTag := testCert(t, key, key.PublicKey(), "(dns org.example.)")
+	otherValid := testCert(t, key, key.PublicKey(), "(dns com.example.)")
+	notAfter := time.Date(2015, time.December, 31, 23, 59, 0, 0, time.UTC)
+	otherValid.Valid.NotAfter = &notAfter
+	parsed, err := EvalAuthCert(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedAgain, err := EvalAuthCert(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedOther, err := EvalAuthCert(otherTag.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nilCert *AuthCert
+	tests := []struct {
+		a, b  *AuthCert
+		equal bool
+	}{
+		{&cert, &same, true},
+		{&cert, &parsed, true},
+		{&parsed, &parsedAgain, true},
+		{&cert, &otherTag, false},
+		{&cert, &otherValid, false},
+		{&parsed, &parsedOther, false},
+		{&cert, nil, false},
+		{nilCert, nil, true},
+	}
+	for i, test := range tests {
+		if test.a.Equal(test.b) != test.equal {
+			t.Errorf("Test %d: expected Equal to be %v", i, test.equal)
+		}
+	}
+}
+
+func TestValid_Union(t *testing.T) {
+	date := func(month time.Month) *time.Time {
+		d := time.Date(2014, month, 1, 0, 0, 0, 0, time.UTC)
+		return &d
+	}
+	tests := []struct {
+		v, v2      Valid
+		contiguous bool
+		u          Valid
+	}{
+		// overlapping
+		{Valid{NotBefore: date(1), NotAfter: date(6)}, Valid{NotBefore: date(3), NotAfter: date(9)}, true, Valid{NotBefore: date(1), NotAfter: date(9)}},
+		{Valid{NotBefore: date(3), NotAfter: date(9)}, Valid{NotBefore: date(1), NotAfter: date(6)}, true, Valid{NotBefore: date(1), NotAfter: date(9)}},
+		{Valid{NotBefore: date(1), NotAfter: date(12)}, Valid{NotBefore: date(3), NotAfter: date(6)}, true, Valid{NotBefore: date(1), NotAfter: date(12)}},
+		// adjacent
+		{Valid{NotBefore: date(1), NotAfter: date(6)}, Valid{NotBefore: date(6), NotAfter: date(9)}, true, Valid{NotBefore: date(1), NotAfter: date(9)}},
+		// disjoint
+		{Valid{NotBefore: date(1), NotAfter: date(3)}, Valid{NotBefore: date(6), NotAfter: date(9)}, false, Valid{}},
+		{Valid{NotBefore: date(6), NotAfter: date(9)}, Valid{NotBefore: date(1), NotAfter: date(3)}, false, Valid{}},
+		// infinite bounds
+		{Valid{NotAfter: date(6)}, Valid{NotBefore: date(3)}, true, Valid{}},
+		{Valid{NotAfter: date(3)}, Valid{NotBefore: date(6), NotAfter: date(9)}, false, Valid{}},
+		{Valid{NotBefore: date(3), NotAfter: date(6)}, Valid{NotAfter: date(4)}, true, Valid{NotAfter: date(6)}},
+		{Valid{}, Valid{NotBefore: date(3), NotAfter: date(6)}, true, Valid{}},
+		// differing online tests
+		{Valid{NotBefore: date(1), NotAfter: date(6)}, Valid{NotBefore: date(3), NotAfter: date(9), Online: []OnlineTest{{Type: "one-time"}}}, false, Valid{}},
+	}
+	for i, test := range tests {
+		contiguous, u := test.v.Union(test.v2)
+		if contiguous != test.contiguous || !validEqual(&u, &test.u) {
+			t.Errorf("Test %d: expected %v %s; got %v %s", i, test.contiguous, test.u.Sexp(), contiguous, u.Sexp())
+		}
+	}
+}
+
+func TestEnableLegacyHashes(t *testing.T) {
+	defer func() {
+		hashesMu.Lock()
+		defer hashesMu.Unlock()
+		delete(KnownHashes, "sha1")
+		delete(hashSizes, "sha1")
+	}()
+	sum := sha1.Sum([]byte("abc"))
+	sexp := Hash{Algorithm: "sha1", Hash: sum[:]}.Sexp()
+	if _, err := EvalHash(sexp); err == nil {
+		t.Error("sha1 accepted by default")
+	}
+	if _, err := HashObject("sha1", []byte("abc")); err == nil {
+		t.Error("sha1 accepted by default")
+	}
+	EnableLegacyHashes()
+	h, err := EvalHash(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.VerifyObject([]byte("abc")) {
+		t.Error("sha1 hash does not verify")
+	}
+}
+
+var normalizeTagTests = []struct {
+	a, b string
+}{
+	{"(dns (* set org.example. com.example.))", "(dns (* set com.example. org.example.))"},
+	{"(dns (* set com.example. com.example. org.example.))", "(dns (* set org.example. com.example.))"},
+	{"(dns (* set com.example. (* set org.example. net.example.)))", "(dns (* set net.example. org.example. com.example.))"},
+	{"(dns (* set com.example.))", "(dns com.example.)"},
+	{"(dns (* set com.example. (*)))", "(dns (*))"},
+	{"(tag (* set (ftp host) (dns com.example.)))", "(tag (* set (dns com.example.) (ftp host)))"},
+	{"(* set (dns (* set b a)) (dns (* set a b)))", "(dns (* set a b))"},
+}
+
+func TestNormalizeTag(t *testing.T) {
+	for _, test := range normalizeTagTests {
+		a, _, err := sexprs.Parse([]byte(test.a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _, err := sexprs.Parse([]byte(test.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		na, nb := NormalizeTag(a), NormalizeTag(b)
+		if !na.Equal(nb) {
+			t.Errorf("%s normalised to %s, but %s to %s", a, na, b, nb)
+		}
+		if !NormalizeTag(na).Equal(na) {
+			t.Errorf("Normalising %s is not idempotent", na)
+		}
+	}
+	empty := sexprs.List{starAtom, setAtom}
+	if NormalizeTag(empty) != nil {
+		t.Error("Expected an empty set to normalise to nil; got", NormalizeTag(empty))
+	}
+	// certificates with differently-ordered tags are equal
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert1 := testCert(t, key, key.PublicKey(), normalizeTagTests[0].a)
+	cert2 := testCert(t, key, key.PublicKey(), normalizeTagTests[0].b)
+	if !cert1.Equal(&cert2) {
+		t.Error("Certificates with equivalent tags are not equal")
+	}
+	// and intersect identically
+	for _, test := range normalizeTagTests[:3] {
+		a, _, _ := sexprs.Parse([]byte(test.a))
+		b, _, _ := sexprs.Parse([]byte(test.b))
+		i, err := IntersectTags(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !i.Equal(NormalizeTag(a)) {
+			t.Errorf("Expected %s intersecting %s & %s; got %s", NormalizeTag(a), a, b, i)
+		}
+	}
+}
+
+// A display hint is not signed, so it cannot change what a certificate
+// grants.
+func TestIntersectTags_DisplayHint(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hinted, _, err := sexprs.Parse([]byte("(ftp [text/plain]host)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _, err := sexprs.Parse([]byte("(ftp host)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := key.IssueAuthCert(key.PublicKey(), hinted, Valid{})
+	sig, err := key.Sign(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := cert
+	stripped.Tag = plain
+	if err := sig.Verify(stripped.Sexp()); err != nil {
+		t.Fatal("Expected the signature to cover the tag without its hint;", err)
+	}
+	i, err := IntersectTags(hinted, plain)
+	if err != nil || !sexpEqual(i, plain) {
+		t.Errorf("Expected %s intersecting %s & %s; got %s, %v", plain, hinted, plain, i, err)
+	}
+	for _, tag := range []string{"(ftp (* prefix [text/plain]ho))", "(ftp (* range alpha ge [text/plain]a))"} {
+		s, _, err := sexprs.Parse([]byte(tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !TagContains(s, plain) {
+			t.Errorf("Expected %s to contain %s", s, plain)
+		}
+	}
+	// parsed, the two are equal in both senses
+	a, err := EvalAuthCert(cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EvalAuthCert(stripped.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Equal(&b) || !a.SemanticEqual(&b) {
+		t.Error("Expected certificates differing only in a hint to be equal")
+	}
+}
+
+func TestAuthCert_Freeze(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a display hint is not part of the canonical form
+	tag := sexprs.List{sexprs.Atom{Value: []byte("dns")}, sexprs.Atom{DisplayHint: []byte("text/plain"), Value: []byte("com.example.")}}
+	cert := key.IssueAuthCert(key.PublicKey(), tag, Valid{})
+	if cert.Expr != nil {
+		t.Fatal("Issued certificate already has an Expr")
+	}
+	// a change made before freezing is kept
+	cert.Depth = 2
+	if err := cert.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashSexp("sha256", cert.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sexp, _, err := sexprs.Parse(cert.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := EvalAuthCert(sexp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := HashSexp("sha256", parsed.Sexp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hash.Equal(hash2) || !bytes.Equal(cert.Pack(), parsed.Pack()) {
+		t.Error("Certificate hash changed on a round-trip:", hash, hash2)
+	}
+	if parsed.Depth != 2 {
+		t.Error("Change to an issued certificate was lost:", parsed)
+	}
+	// one made after freezing is not, until Expr is cleared
+	cert.Depth = 3
+	if !bytes.Equal(cert.Pack(), parsed.Pack()) {
+		t.Error("Frozen certificate changed:", cert)
+	}
+	cert.Expr = nil
+	if bytes.Equal(cert.Pack(), parsed.Pack()) {
+		t.Error("Thawed certificate did not change:", cert)
+	}
+}
+
+func TestPublicKey_AsSubject(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := sexprs.List{sexprs.Atom{Value: []byte("dns")}}
+	hashed := key.IssueAuthCert(subject.PublicKey().AsSubject(false), tag, Valid{})
+	full := key.IssueAuthCert(subject.PublicKey().AsSubject(true), tag, Valid{})
+	hash, err := subject.PublicKey().HashExp("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !subjectSexp(hashed.Subject).Equal(hash.Sexp()) {
+		t.Error("Expected a hash subject; got", subjectSexp(hashed.Subject))
+	}
+	if !subjectSexp(full.Subject).Equal(subject.PublicKey().Sexp()) {
+		t.Error("Expected a public-key subject; got", subjectSexp(full.Subject))
+	}
+	if len(full.Pack()) <= len(hashed.Pack()) {
+		t.Error("Expected the full key to make a larger certificate")
+	}
+	for _, cert := range []AuthCert{hashed, full} {
+		parsed, err := EvalAuthCert(cert.Sexp())
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, ok := parsed.SubjectKey()
+		if !ok || !k.Equal(subject.PublicKey()) {
+			t.Error("Expected subject", subject.PublicKey(), "; got", parsed.Subject)
+		}
+		if !parsed.SemanticEqual(&hashed) || !parsed.SemanticEqual(&full) {
+			t.Error("Expected certificates with hashed & full subjects to be equivalent")
+		}
+	}
+}
+
+func TestPrivateKey_MarshalPKCS8(t *testing.T) {
+	for _, curve := range []string{"p256", "p384"} {
+		key, err := GeneratePrivateKey("(ecdsa-sha2 (curve " + curve + "))")
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := key.MarshalPKCS8()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// standard tooling understands it
+		if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+			t.Fatal(err)
+		}
+		key2, err := PrivateKeyFromPKCS8(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key2.Equal(key) {
+			t.Errorf("Expected %s; got %s", key, key2)
+		}
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrivateKeyFromPKCS8(der); err == nil {
+		t.Error("Expected an error importing an Ed25519 key")
+	}
+	p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKCS8PrivateKey(p521)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var curveErr UnsupportedCurveError
+	if _, err := PrivateKeyFromPKCS8(der); !errors.As(err, &curveErr) {
+		t.Error("Expected an UnsupportedCurveError; got", err)
+	}
+	if _, err := (&PrivateKey{HashKey{}, *p521}).MarshalPKCS8(); !errors.As(err, &curveErr) {
+		t.Error("Expected an UnsupportedCurveError; got", err)
+	}
+}
+
+func TestPrivateKey_SignWith(t *testing.T) {
+	key, err := GeneratePrivateKey("(ecdsa-sha2 (curve p256))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := sexprs.Atom{Value: []byte("This is a message for signing")}
+	sig, err := key.SignWith(message, "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Hash.Algorithm != "sha512" {
+		t.Errorf("Expected sha512; got %s", sig.Hash.Algorithm)
+	}
+	if err = sig.Verify(message); err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := EvalSignature(sig.Sexp(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sig2.Verify(message); err != nil {
+		t.Error(err)
+	}
+	if err = sig.Verify(sexprs.Atom{Value: []byte("Some other message")}); err == nil {
+		t.Error("Signature verified a different message")
+	}
+	if _, err = key.SignWith(message, "md5"); err == nil {
+		t.Error("Expected an error signing under an unknown algorithm")
+	}
+}
@@ -8,10 +8,51 @@ import (
 	"github.com/eadmund/sexprs"
 )
 
+// A Subject is anything which may be the subject of a certificate.
 type Subject interface {
-	// SubjectSexp returns an S-expression suitable for use as a
+	// Subject returns an S-expression suitable for use as a
 	// subject object of a certificate, e.g. the hash expression
 	// in "(subject (hash sha256
-	// |5v5x48LHmVtW1du0iMqdgK+v6/oybSBU/NCYne0XCMw=|))".
+	// |5v5x48LHmVtW1du0iMqdgK+v6/oybSBU/NCYne0XCMw=|))", or nil if
+	// none can be produced, e.g. for a key on an unknown curve.
 	Subject() sexprs.Sexp
-}
\ No newline at end of file
+}
+
+var (
+	_ Subject = Hash{}
+	_ Subject = HashKey{}
+	_ Subject = (*PublicKey)(nil)
+	_ Subject = (*PrivateKey)(nil)
+	_ Subject = (*Name)(nil)
+	_ Subject = KeySubject{}
+)
+
+// A KeySubject is a public key which, as the subject of a certificate,
+// is written out in full, as (public-key ...), rather than by its hash
+// as a *PublicKey or an *RSAPublicKey is.  Full keys make certificates
+// self-contained; hashes keep them small.  See PublicKey.AsSubject &
+// RSAPublicKey.AsSubject.
+type KeySubject struct {
+	Key Key // a *PublicKey or an *RSAPublicKey
+}
+
+// Subject returns s's key as a public-key S-expression, or nil if it
+// has none.
+func (s KeySubject) Subject() sexprs.Sexp {
+	if s.Key == nil {
+		return nil
+	}
+	return s.Key.Sexp()
+}
+
+// AsSubject returns k as a Subject which is written as its hash, i.e.
+// k itself, or if full is true as the full key, i.e. a KeySubject.
+func (k *PublicKey) AsSubject(full bool) Subject {
+	if full {
+		if k == nil {
+			return KeySubject{}
+		}
+		return KeySubject{k}
+	}
+	return k
+}
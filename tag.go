@@ -0,0 +1,541 @@
+// Copyright 2013 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/eadmund/sexprs"
+	"math/big"
+	"sort"
+)
+
+var (
+	tagAtom    = sexprs.Atom{Value: []byte("tag")}
+	starAtom   = sexprs.Atom{Value: []byte("*")}
+	setAtom    = sexprs.Atom{Value: []byte("set")}
+	prefixAtom = sexprs.Atom{Value: []byte("prefix")}
+	rangeAtom  = sexprs.Atom{Value: []byte("range")}
+)
+
+// IntersectTags returns the most specific tag authorised by both a &
+// b, following the rules of section 8.3 of the SPKI certificate
+// structure draft.  Either tag may be a full (tag ...) expression or
+// just its body; the result is a full (tag ...) expression if either
+// was.  The tag (*) authorises everything.  If a & b do not overlap
+// then the result is nil, which no tag written out can be: an atom
+// such as null is an ordinary tag.  An error is returned if either tag
+// is malformed or if their intersection cannot be expressed, e.g. that
+// of two ranges with differing orderings.  Both tags and the result are normalised,
+// as by NormalizeTag.  Any object in either tag of the form
+// (do hash ALGORITHM OBJECT) stands for the hash of OBJECT, so that
+// the tag may be compared with one naming the object by its hash.
+// Display hints are ignored, as they are no part of the canonical form
+// which is signed: byte-strings are compared by their values alone.
+func IntersectTags(a, b sexprs.Sexp) (sexprs.Sexp, error) {
+	a, aWrapped, err := tagBody(a)
+	if err != nil {
+		return nil, err
+	}
+	b, bWrapped, err := tagBody(b)
+	if err != nil {
+		return nil, err
+	}
+	if a, err = hashTagObjects(a); err != nil {
+		return nil, err
+	}
+	if b, err = hashTagObjects(b); err != nil {
+		return nil, err
+	}
+	t, err := intersectTags(NormalizeTag(a), NormalizeTag(b))
+	if err != nil {
+		return nil, err
+	}
+	t = NormalizeTag(t)
+	if t == nil {
+		return nil, nil
+	}
+	if aWrapped || bWrapped {
+		return sexprs.List{tagAtom, t}, nil
+	}
+	return t, nil
+}
+
+// TagContains returns true if the tag authorized authorises everything
+// which the tag requested asks for, i.e. if requested is a subset of
+// authorized: (*) contains every tag, a prefix contains the strings it
+// begins, a set contains each of its members, a range contains the
+// values within it and any other expression contains those of which it
+// is a prefix.  It is the check a server makes before granting a
+// request.  TagContains returns false if either tag is malformed.
+func TagContains(authorized, requested sexprs.Sexp) bool {
+	contains, err := tagContains(authorized, requested)
+	return err == nil && contains
+}
+
+// tagContains returns true if requested is a subset of authorized,
+// i.e. if their intersection is requested itself, or an error if the
+// two cannot be intersected.
+func tagContains(authorized, requested sexprs.Sexp) (bool, error) {
+	t, err := IntersectTags(authorized, requested)
+	if err != nil || t == nil {
+		return false, err
+	}
+	granted, _, err := tagBody(t)
+	if err != nil {
+		return false, err
+	}
+	wanted, _, err := tagBody(requested)
+	if err != nil {
+		return false, err
+	}
+	if wanted, err = hashTagObjects(wanted); err != nil {
+		return false, err
+	}
+	return sexpEqual(granted, NormalizeTag(wanted)), nil
+}
+
+// tagBody returns the body of the tag s, without its display hints, and
+// whether s was wrapped in a (tag ...) expression.
+func tagBody(s sexprs.Sexp) (body sexprs.Sexp, wrapped bool, err error) {
+	s = canonicalSexp(s)
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) == 0 || !tagAtom.Equal(l[0]) {
+		if s == nil {
+			return nil, false, fmt.Errorf("Tag must not be empty")
+		}
+		return s, false, nil
+	}
+	if len(l) != 2 {
+		return nil, false, fmt.Errorf("Tag must be of the form (tag TAG-EXPR)")
+	}
+	return l[1], true, nil
+}
+
+func intersectTags(a, b sexprs.Sexp) (sexprs.Sexp, error) {
+	switch {
+	case a == nil || b == nil:
+		return nil, nil
+	case isStarTag(a):
+		return b, nil
+	case isStarTag(b):
+		return a, nil
+	case a.Equal(b):
+		return a, nil
+	}
+	if set, ok := starForm(a, setAtom); ok {
+		return intersectSet(set, b)
+	}
+	if set, ok := starForm(b, setAtom); ok {
+		return intersectSet(set, a)
+	}
+	if p, ok := starForm(a, prefixAtom); ok {
+		return intersectPrefix(p, b)
+	}
+	if p, ok := starForm(b, prefixAtom); ok {
+		return intersectPrefix(p, a)
+	}
+	if r, ok := starForm(a, rangeAtom); ok {
+		return intersectRange(r, b)
+	}
+	if r, ok := starForm(b, rangeAtom); ok {
+		return intersectRange(r, a)
+	}
+	if l, ok := a.(sexprs.List); ok && len(l) > 0 && starAtom.Equal(l[0]) {
+		return nil, fmt.Errorf("Unknown tag form %s", a)
+	}
+	if l, ok := b.(sexprs.List); ok && len(l) > 0 && starAtom.Equal(l[0]) {
+		return nil, fmt.Errorf("Unknown tag form %s", b)
+	}
+	al, aOK := a.(sexprs.List)
+	bl, bOK := b.(sexprs.List)
+	if !aOK || !bOK {
+		// two differing byte-strings, or a byte-string & a list
+		return nil, nil
+	}
+	return intersectSimpleTags(al, bl)
+}
+
+// intersectSimpleTags intersects two lists element by element.  Tags
+// are extendable, so the elements with which the longer list extends
+// the shorter further restrict it and are kept as they are.
+func intersectSimpleTags(a, b sexprs.List) (sexprs.Sexp, error) {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	result := make(sexprs.List, len(a))
+	for i := range a {
+		if i >= len(b) {
+			result[i] = a[i]
+			continue
+		}
+		t, err := intersectTags(a[i], b[i])
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return nil, nil
+		}
+		result[i] = t
+	}
+	return result, nil
+}
+
+// intersectSet intersects each member of the (* set ...) form set with
+// t, returning a set of the non-empty results.
+func intersectSet(set sexprs.List, t sexprs.Sexp) (sexprs.Sexp, error) {
+	var result sexprs.List
+	for _, member := range set {
+		i, err := intersectTags(member, t)
+		if err != nil {
+			return nil, err
+		}
+		if i == nil {
+			continue
+		}
+		if l, ok := starForm(i, setAtom); ok {
+			result = append(result, l...)
+		} else {
+			result = append(result, i)
+		}
+	}
+	switch len(result) {
+	case 0:
+		return nil, nil
+	case 1:
+		return result[0], nil
+	}
+	return append(sexprs.List{starAtom, setAtom}, result...), nil
+}
+
+// intersectPrefix intersects the arguments of the (* prefix ...) form
+// p with t.
+func intersectPrefix(p sexprs.List, t sexprs.Sexp) (sexprs.Sexp, error) {
+	if len(p) != 1 {
+		return nil, fmt.Errorf("Prefix tag must be of the form (* prefix STRING)")
+	}
+	prefix, ok := p[0].(sexprs.Atom)
+	if !ok {
+		return nil, fmt.Errorf("Prefix tag must be of the form (* prefix STRING)")
+	}
+	if p2, ok := starForm(t, prefixAtom); ok {
+		if len(p2) != 1 {
+			return nil, fmt.Errorf("Prefix tag must be of the form (* prefix STRING)")
+		}
+		prefix2, ok := p2[0].(sexprs.Atom)
+		if !ok {
+			return nil, fmt.Errorf("Prefix tag must be of the form (* prefix STRING)")
+		}
+		switch {
+		case bytes.HasPrefix(prefix2.Value, prefix.Value):
+			return t, nil
+		case bytes.HasPrefix(prefix.Value, prefix2.Value):
+			return sexprs.List{starAtom, prefixAtom, prefix}, nil
+		}
+		return nil, nil
+	}
+	if _, ok := starForm(t, rangeAtom); ok {
+		return nil, fmt.Errorf("Cannot intersect a prefix with a range")
+	}
+	s, ok := t.(sexprs.Atom)
+	if !ok || !bytes.HasPrefix(s.Value, prefix.Value) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// intersectRange intersects the arguments of the (* range ...) form r
+// with t.
+func intersectRange(r sexprs.List, t sexprs.Sexp) (sexprs.Sexp, error) {
+	tr, err := evalTagRange(r)
+	if err != nil {
+		return nil, err
+	}
+	if r2, ok := starForm(t, rangeAtom); ok {
+		if sexprs.List(r).Equal(r2) {
+			return t, nil
+		}
+		tr2, err := evalTagRange(r2)
+		if err != nil {
+			return nil, err
+		}
+		return tr.intersect(tr2, r, r2)
+	}
+	s, ok := t.(sexprs.Atom)
+	if !ok || !tr.contains(s) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// A tagRange is a parsed (* range ORDERING LOW? HIGH?) form.
+type tagRange struct {
+	ordering   string
+	low, high  *sexprs.Atom
+	lowStrict  bool // true for (g X), false for (ge X)
+	highStrict bool // true for (l X), false for (le X)
+}
+
+func evalTagRange(r sexprs.List) (tr tagRange, err error) {
+	if len(r) < 1 || len(r) > 5 {
+		return tr, fmt.Errorf("Range tag must be of the form (* range ORDERING LIMIT*)")
+	}
+	ordering, ok := r[0].(sexprs.Atom)
+	if !ok {
+		return tr, fmt.Errorf("Range ordering must be a byte-string")
+	}
+	tr.ordering = string(ordering.Value)
+	switch tr.ordering {
+	case "alpha", "numeric", "time", "binary", "date":
+	default:
+		return tr, fmt.Errorf("Unknown range ordering %s", tr.ordering)
+	}
+	limits := r[1:]
+	if len(limits)%2 != 0 {
+		return tr, fmt.Errorf("Range limits must be of the form g|ge|l|le STRING")
+	}
+	for i := 0; i < len(limits); i += 2 {
+		op, ok := limits[i].(sexprs.Atom)
+		if !ok {
+			return tr, fmt.Errorf("Range limits must be of the form g|ge|l|le STRING")
+		}
+		limit, ok := limits[i+1].(sexprs.Atom)
+		if !ok {
+			return tr, fmt.Errorf("Range limit must be a byte-string")
+		}
+		switch string(op.Value) {
+		case "g", "ge":
+			if tr.low != nil {
+				return tr, fmt.Errorf("Range must have at most one lower limit")
+			}
+			tr.low, tr.lowStrict = &limit, string(op.Value) == "g"
+		case "l", "le":
+			if tr.high != nil {
+				return tr, fmt.Errorf("Range must have at most one upper limit")
+			}
+			tr.high, tr.highStrict = &limit, string(op.Value) == "l"
+		default:
+			return tr, fmt.Errorf("Unknown range limit %s", op.Value)
+		}
+	}
+	return tr, nil
+}
+
+// intersect returns the range of values within both tr & tr2, which
+// were parsed from the range arguments r & r2: the greater of their
+// lower limits and the lesser of their upper limits.  If the result is
+// one of the two ranges then it is returned as it was written.  The
+// result is nil if the ranges do not overlap, and an error if their
+// orderings differ or their limits cannot be compared.
+func (tr tagRange) intersect(tr2 tagRange, r, r2 sexprs.List) (sexprs.Sexp, error) {
+	if tr.ordering != tr2.ordering {
+		return nil, fmt.Errorf("Cannot intersect %s & %s ranges", tr.ordering, tr2.ordering)
+	}
+	result := tr
+	var err error
+	result.low, result.lowStrict, err = tr.limit(tr.low, tr.lowStrict, tr2.low, tr2.lowStrict, 1)
+	if err != nil {
+		return nil, err
+	}
+	result.high, result.highStrict, err = tr.limit(tr.high, tr.highStrict, tr2.high, tr2.highStrict, -1)
+	if err != nil {
+		return nil, err
+	}
+	if result.low != nil && result.high != nil {
+		c, ok := tr.compare(*result.low, *result.high)
+		if !ok {
+			return nil, fmt.Errorf("Range limits %s & %s cannot be compared", result.low, result.high)
+		}
+		if c > 0 || (c == 0 && (result.lowStrict || result.highStrict)) {
+			return nil, nil
+		}
+	}
+	switch {
+	case result.equal(tr2):
+		return append(sexprs.List{starAtom, rangeAtom}, r2...), nil
+	case result.equal(tr):
+		return append(sexprs.List{starAtom, rangeAtom}, r...), nil
+	}
+	return result.sexp(), nil
+}
+
+// limit returns the more restrictive of the limits a & b, each of
+// which may be strict, where sign is 1 for lower limits and -1 for
+// upper ones.  A missing limit is no restriction.
+func (tr tagRange) limit(a *sexprs.Atom, aStrict bool, b *sexprs.Atom, bStrict bool, sign int) (*sexprs.Atom, bool, error) {
+	switch {
+	case a == nil:
+		return b, bStrict, nil
+	case b == nil:
+		return a, aStrict, nil
+	}
+	c, ok := tr.compare(*a, *b)
+	if !ok {
+		return nil, false, fmt.Errorf("Range limits %s & %s cannot be compared", a, b)
+	}
+	switch c * sign {
+	case 1:
+		return a, aStrict, nil
+	case -1:
+		return b, bStrict, nil
+	}
+	return a, aStrict || bStrict, nil
+}
+
+// equal returns true if tr & tr2 have the same ordering and limits.
+func (tr tagRange) equal(tr2 tagRange) bool {
+	limitEqual := func(a, b *sexprs.Atom) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return a.Equal(*b)
+	}
+	return tr.ordering == tr2.ordering &&
+		limitEqual(tr.low, tr2.low) && tr.lowStrict == tr2.lowStrict &&
+		limitEqual(tr.high, tr2.high) && tr.highStrict == tr2.highStrict
+}
+
+// sexp returns tr as a (* range ORDERING LOW? HIGH?) form.
+func (tr tagRange) sexp() sexprs.List {
+	l := sexprs.List{starAtom, rangeAtom, sexprs.Atom{Value: []byte(tr.ordering)}}
+	if tr.low != nil {
+		op := "ge"
+		if tr.lowStrict {
+			op = "g"
+		}
+		l = append(l, sexprs.Atom{Value: []byte(op)}, *tr.low)
+	}
+	if tr.high != nil {
+		op := "le"
+		if tr.highStrict {
+			op = "l"
+		}
+		l = append(l, sexprs.Atom{Value: []byte(op)}, *tr.high)
+	}
+	return l
+}
+
+// contains returns true if s lies within tr.
+func (tr tagRange) contains(s sexprs.Atom) bool {
+	if tr.low != nil {
+		c, ok := tr.compare(s, *tr.low)
+		if !ok || c < 0 || (c == 0 && tr.lowStrict) {
+			return false
+		}
+	}
+	if tr.high != nil {
+		c, ok := tr.compare(s, *tr.high)
+		if !ok || c > 0 || (c == 0 && tr.highStrict) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare compares a & b under tr's ordering, returning false if they
+// are not comparable.  Times & dates are compared as strings, which
+// orders them correctly so long as they share a format.
+func (tr tagRange) compare(a, b sexprs.Atom) (int, bool) {
+	switch tr.ordering {
+	case "numeric":
+		x, ok := new(big.Rat).SetString(string(a.Value))
+		if !ok {
+			return 0, false
+		}
+		y, ok := new(big.Rat).SetString(string(b.Value))
+		if !ok {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case "binary":
+		return new(big.Int).SetBytes(a.Value).Cmp(new(big.Int).SetBytes(b.Value)), true
+	}
+	return bytes.Compare(a.Value, b.Value), true
+}
+
+// starForm returns the arguments of s if it is a (* kind ...) form.
+func starForm(s sexprs.Sexp, kind sexprs.Atom) (args sexprs.List, ok bool) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) < 2 || !starAtom.Equal(l[0]) || !kind.Equal(l[1]) {
+		return nil, false
+	}
+	return l[2:], true
+}
+
+// isStarTag returns true if s is (*), which authorises everything.
+func isStarTag(s sexprs.Sexp) bool {
+	l, ok := s.(sexprs.List)
+	return ok && len(l) == 1 && starAtom.Equal(l[0])
+}
+
+// NormalizeTag returns tag in a normal form, so that tags which differ
+// only in how they are written compare equal: the members of each
+// (* set ...) form are normalised, nested sets are flattened, duplicate
+// members are removed and the rest sorted by their canonical forms.  A
+// set including (*) is just (*), and a set with a single member is
+// just that member.  An empty set, like any tag with one among its
+// elements, authorises nothing, and normalises to nil.  Display hints,
+// which are not signed, are dropped.
+func NormalizeTag(tag sexprs.Sexp) sexprs.Sexp {
+	return normalizeTag(canonicalSexp(tag))
+}
+
+// normalizeTag returns the normal form of tag, which has no display
+// hints.
+func normalizeTag(tag sexprs.Sexp) sexprs.Sexp {
+	l, ok := tag.(sexprs.List)
+	if !ok {
+		return tag
+	}
+	if set, ok := starForm(l, setAtom); ok {
+		return normalizeSet(set)
+	}
+	result := make(sexprs.List, len(l))
+	for i, elt := range l {
+		if result[i] = normalizeTag(elt); result[i] == nil {
+			return nil
+		}
+	}
+	return result
+}
+
+// normalizeSet returns the normal form of a set with the given
+// members.
+func normalizeSet(set sexprs.List) sexprs.Sexp {
+	members := make(map[string]sexprs.Sexp)
+	var add func(set sexprs.List)
+	add = func(set sexprs.List) {
+		for _, member := range set {
+			member = normalizeTag(member)
+			if inner, ok := starForm(member, setAtom); ok {
+				add(inner)
+				continue
+			}
+			if member != nil {
+				members[string(member.Pack())] = member
+			}
+		}
+	}
+	add(set)
+	keys := make([]string, 0, len(members))
+	for key, member := range members {
+		if isStarTag(member) {
+			return member
+		}
+		keys = append(keys, key)
+	}
+	switch len(keys) {
+	case 0:
+		return nil
+	case 1:
+		return members[keys[0]]
+	}
+	sort.Strings(keys)
+	result := sexprs.List{starAtom, setAtom}
+	for _, key := range keys {
+		result = append(result, members[key])
+	}
+	return result
+}
@@ -1,13 +1,23 @@
 package spki
 
 import (
+	"fmt"
 	"time"
 	"github.com/eadmund/sexprs"
 )
 
 var (
+	validAtom     = sexprs.Atom{Value: []byte("valid")}
+	notBeforeAtom = sexprs.Atom{Value: []byte("not-before")}
+	notAfterAtom  = sexprs.Atom{Value: []byte("not-after")}
+
 	// SPKI v0 uses a non-ISO date representation.
-	V0DateFmt = "2006-01-02_15:04:00"
+	V0DateFmt = "2006-01-02_15:04:05"
+
+	// Now returns the current time, as used by NowValid.  It exists
+	// only so that tests may substitute a fixed clock; other code
+	// should never change it.
+	Now = time.Now
 )
 
 // If times were represented as simple strings, then all the fancy
@@ -17,9 +27,12 @@ var (
 
 // A Valid represents certificate validity.  A nil NotBefore
 // represents an infinitely-early beginning; a nil NotAfter represents
-// an infinitely-late end.
+// an infinitely-late end.  SPKI times are always UTC; times in other
+// locations are converted to UTC when serialised.  Online lists any
+// online tests which must also pass.
 type Valid struct {
 	NotBefore, NotAfter *time.Time
+	Online              []OnlineTest
 }
 
 func (v Valid) Intersect(v2 Valid) (nonEmpty bool, i Valid) {
@@ -51,25 +64,237 @@ func (v Valid) Intersect(v2 Valid) (nonEmpty bool, i Valid) {
 	}
 	// if NotBefore comes after NotAfter, it's an empty validity interval
 	if i.NotBefore != nil && i.NotAfter != nil && i.NotBefore.After(*i.NotAfter) {
-		return false, Valid{nil, nil}
+		return false, Valid{}
+	}
+	// both sets of online tests must pass
+	if len(v.Online)+len(v2.Online) > 0 {
+		i.Online = append(append([]OnlineTest(nil), v.Online...), v2.Online...)
 	}
 	return true, i
 }
 
+// Union returns the single validity period covering both v & v2, if
+// they overlap or touch, i.e. if one ends at the very instant the other
+// begins; otherwise contiguous is false.  As for Intersect, nil bounds
+// are infinite.  It is meant for merging renewals of the same
+// authorisation, so the two must have the same online tests.
+func (v Valid) Union(v2 Valid) (contiguous bool, u Valid) {
+	if !onlineEqual(v.Online, v2.Online) {
+		return false, Valid{}
+	}
+	// the later of the two must begin no later than the earlier ends
+	first, second := v, v2
+	if v.NotBefore != nil && (v2.NotBefore == nil || v2.NotBefore.Before(*v.NotBefore)) {
+		first, second = v2, v
+	}
+	if first.NotAfter != nil && second.NotBefore != nil && second.NotBefore.After(*first.NotAfter) {
+		return false, Valid{}
+	}
+	u.NotBefore = first.NotBefore
+	// u.NotAfter = max(v.NotAfter, v2.NotAfter)
+	switch {
+	case v.NotAfter == nil || v2.NotAfter == nil:
+		u.NotAfter = nil
+	case v.NotAfter.After(*v2.NotAfter):
+		u.NotAfter = v.NotAfter
+	default:
+		u.NotAfter = v2.NotAfter
+	}
+	u.Online = v.Online
+	return true, u
+}
+
+// Contains returns true if v includes the instant t.  Both bounds are
+// inclusive: a certificate is valid at the very instant of its
+// NotBefore & of its NotAfter.
+func (v Valid) Contains(t time.Time) bool {
+	if v.NotBefore != nil && t.Before(*v.NotBefore) {
+		return false
+	}
+	if v.NotAfter != nil && t.After(*v.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// NowValid returns true if v includes the current time, according to
+// Now.
+func (v Valid) NowValid() bool {
+	return v.Contains(Now())
+}
+
+// validEqual returns true if a & b represent the same validity period.
+// A nil Valid is the same as one with neither bound.
+func validEqual(a, b *Valid) bool {
+	if a == nil {
+		a = &Valid{}
+	}
+	if b == nil {
+		b = &Valid{}
+	}
+	return timeEqual(a.NotBefore, b.NotBefore) && timeEqual(a.NotAfter, b.NotAfter) && onlineEqual(a.Online, b.Online)
+}
+
+// onlineEqual returns true if a & b are the same online tests, in the
+// same order.
+func onlineEqual(a, b []OnlineTest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sexpEqual(a[i].Sexp(), b[i].Sexp()) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequiresOnlineCheck returns true if v has any online tests, which
+// must be checked (e.g. with CheckOnline) before v may be relied upon.
+func (v Valid) RequiresOnlineCheck() bool {
+	return len(v.Online) > 0
+}
+
+// IsOneTime returns true if v has a one-time online test, i.e. one of
+// the form (online one-time ...).  Such a test is valid only for a
+// single verification, so anything derived from v, such as the result
+// of reducing a chain of certificates, must not be cached.
+func (v Valid) IsOneTime() bool {
+	for _, t := range v.Online {
+		if t.Type == "one-time" {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOnline runs each of v's online tests with check, returning true
+// only if all of them pass.  It stops at the first test which fails or
+// returns an error.
+func (v Valid) CheckOnline(check OnlineChecker) (bool, error) {
+	for _, t := range v.Online {
+		ok, err := check(t)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func timeEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+// Sexp returns v as an S-expression, with its dates in V0DateFmt.
 func (v Valid) Sexp() sexprs.Sexp {
-	var notBefore, notAfter sexprs.Sexp
+	return v.sexp(V0DateFmt)
+}
+
+// SexpISO returns v as an S-expression, as Sexp, but with its dates in
+// the ISO 8601 format of RFC 3339, e.g. 2014-12-31T23:59:59Z, for the
+// benefit of other tools.  EvalValid accepts either format.
+func (v Valid) SexpISO() sexprs.Sexp {
+	return v.sexp(time.RFC3339)
+}
+
+func (v Valid) sexp(format string) sexprs.Sexp {
+	if v.NotBefore == nil && v.NotAfter == nil && len(v.Online) == 0 {
+		return nil
+	}
+	s := sexprs.List{validAtom}
 	if v.NotBefore != nil {
-		notBefore = sexprs.List{sexprs.Atom{Value: []byte("not-before")}, sexprs.Atom{Value: []byte(v.NotBefore.Format(V0DateFmt))}}
+		s = append(s, sexprs.List{notBeforeAtom, sexprs.Atom{Value: []byte(v.NotBefore.UTC().Format(format))}})
 	}
 	if v.NotAfter != nil {
-		notAfter = sexprs.List{sexprs.Atom{Value: []byte("not-after")}, sexprs.Atom{Value: []byte(v.NotAfter.Format(V0DateFmt))}}
+		s = append(s, sexprs.List{notAfterAtom, sexprs.Atom{Value: []byte(v.NotAfter.UTC().Format(format))}})
+	}
+	for _, t := range v.Online {
+		s = append(s, t.Sexp())
 	}
-	if notBefore == nil && notAfter == nil {
+	return s
+}
+
+// EvalValid converts a validity S-expression to a Valid.  A validity
+// looks like:
+//    (valid (not-before "2014-01-01_00:00:00") (not-after "2014-12-31_23:59:00"))
+// Either bound may be omitted, in which case the corresponding field of
+// v is nil.  Dates are in V0DateFmt and are always UTC, or else in the
+// ISO 8601 format of RFC 3339.  The bounds may be followed by any
+// number of online tests.
+func EvalValid(s sexprs.Sexp) (v Valid, err error) {
+	l, ok := s.(sexprs.List)
+	if !ok || len(l) < 1 || !validAtom.Equal(l[0]) {
+		return v, fmt.Errorf("Validity must be of the form (valid [(not-before DATE)] [(not-after DATE)] ONLINE-TEST*)")
+	}
+	for _, bound := range l[1:] {
+		bl, ok := bound.(sexprs.List)
+		if ok && len(bl) > 0 && onlineAtom.Equal(bl[0]) {
+			t, err := EvalOnlineTest(bl)
+			if err != nil {
+				return Valid{}, err
+			}
+			v.Online = append(v.Online, t)
+			continue
+		}
+		if len(v.Online) > 0 {
+			return Valid{}, fmt.Errorf("Validity dates must precede online tests")
+		}
+		if !ok || len(bl) != 2 {
+			return Valid{}, fmt.Errorf("Validity bound must be of the form (not-before DATE) or (not-after DATE)")
+		}
+		date, ok := bl[1].(sexprs.Atom)
+		if !ok {
+			return Valid{}, fmt.Errorf("Validity date must be an atom")
+		}
+		t, err := parseDate(string(date.Value))
+		if err != nil {
+			return Valid{}, err
+		}
+		switch {
+		case notBeforeAtom.Equal(bl[0]) && v.NotBefore == nil:
+			v.NotBefore = &t
+		case notAfterAtom.Equal(bl[0]) && v.NotAfter == nil:
+			v.NotAfter = &t
+		default:
+			return Valid{}, fmt.Errorf("Unexpected validity bound %s", bl[0])
+		}
+	}
+	return v, nil
+}
+
+// parseDate parses date in either V0DateFmt or RFC 3339 format,
+// returning it in UTC.
+func parseDate(date string) (time.Time, error) {
+	t, err := time.Parse(V0DateFmt, date)
+	if err == nil {
+		return t, nil
+	}
+	t, isoErr := time.Parse(time.RFC3339, date)
+	if isoErr != nil {
+		return time.Time{}, fmt.Errorf("Invalid validity date %q: %s", date, err)
+	}
+	return t.UTC(), nil
+}
+
+// Pack returns v's canonical S-expression form, or nil if v is
+// unbounded and so has no S-expression.
+func (v Valid) Pack() []byte {
+	s := v.Sexp()
+	if s == nil {
 		return nil
 	}
-	return sexprs.List{sexprs.Atom{Value: []byte("valid")}, notBefore, notAfter}
+	return s.Pack()
 }
 
+// String returns v's advanced S-expression form, or the empty string if
+// v is unbounded.
 func (v Valid) String() string {
-	return v.Sexp().String()
+	s := v.Sexp()
+	if s == nil {
+		return ""
+	}
+	return s.String()
 }
\ No newline at end of file
@@ -0,0 +1,89 @@
+// Copyright 2014 Robert A. Uhl.  All rights reserved.
+// Use of this source code is governed by an MIT-style license which may
+// be found in the LICENSE file.
+
+package spki
+
+import (
+	"bufio"
+	"github.com/eadmund/sexprs"
+	"io"
+	"sync"
+)
+
+// packWriters holds the buffered writers with which Sequence.WriteTo
+// collects packed elements, so that neither is a buffer allocated for
+// each call nor is each element written to the underlying writer on
+// its own.
+var packWriters = sync.Pool{
+	New: func() interface{} { return bufio.NewWriter(nil) },
+}
+
+// A countingWriter counts the bytes which reach w through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// writeSexp writes the canonical form of s, as returned by s.Pack(), to
+// w in a single write, returning the number of bytes written and any
+// error encountered.
+func writeSexp(w io.Writer, s sexprs.Sexp) (int64, error) {
+	n, err := w.Write(s.Pack())
+	return int64(n), err
+}
+
+// WriteTo writes k's canonical S-expression form to w.  It returns an
+// UnsupportedCurveError if k's curve is not supported.
+func (k *PublicKey) WriteTo(w io.Writer) (int64, error) {
+	s, err := k.SexpErr()
+	if err != nil {
+		return 0, err
+	}
+	return writeSexp(w, s)
+}
+
+// WriteTo writes sig's canonical S-expression form to w.
+func (sig *Signature) WriteTo(w io.Writer) (int64, error) {
+	return writeSexp(w, sig.Sexp())
+}
+
+// WriteTo writes h's canonical S-expression form to w.
+func (h Hash) WriteTo(w io.Writer) (int64, error) {
+	return writeSexp(w, h.Sexp())
+}
+
+// WriteTo writes a's canonical S-expression form to w.
+func (a AuthCert) WriteTo(w io.Writer) (int64, error) {
+	return writeSexp(w, a.Sexp())
+}
+
+// WriteTo writes seq's canonical S-expression form to w.  Its elements
+// are packed one at a time into a buffer which is written out as it
+// fills, so that a long sequence is never held in memory in its packed
+// form, yet reaches w in a few large writes.
+func (seq Sequence) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := packWriters.Get().(*bufio.Writer)
+	bw.Reset(cw)
+	defer func() {
+		bw.Reset(nil)
+		packWriters.Put(bw)
+	}()
+	bw.WriteByte('(')
+	bw.Write(sequenceAtom.Pack())
+	for _, elt := range seq {
+		if _, err := bw.Write(elt.Sexp().Pack()); err != nil {
+			return cw.n, err
+		}
+	}
+	bw.WriteByte(')')
+	err := bw.Flush()
+	return cw.n, err
+}